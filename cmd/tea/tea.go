@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	_ "embed"
 	"errors"
 	"fmt"
@@ -9,14 +8,24 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/fatih/color"
+	"github.com/nagylzs/tea/internal/expand"
+	"github.com/nagylzs/tea/internal/fields"
+	"github.com/nagylzs/tea/internal/lines"
 	"github.com/nagylzs/tea/internal/opts"
+	"github.com/nagylzs/tea/internal/proc"
+	"github.com/nagylzs/tea/internal/pty"
+	"github.com/nagylzs/tea/internal/stdin"
+	"github.com/nagylzs/tea/internal/vars"
 	"github.com/nagylzs/tea/internal/version"
 	"golang.org/x/sys/unix"
 )
@@ -24,29 +33,91 @@ import (
 //go:embed USAGE.txt
 var Usage string
 
+// Child is a running instance of PROGRAM. A new instance is started whenever PROGRAM is restarted.
+type Child struct {
+	Cmd              *exec.Cmd
+	StdOut           io.ReadCloser
+	StdErr           io.ReadCloser
+	Started          time.Time
+	Exited           chan struct{} // closed when the process exits
+	RestartRequested *atomic.Bool  // a --restart action was performed for this instance
+	Escalated        *atomic.Int32 // the last signal sent to this instance by --kill-after escalation, or 0
+	Foreground       bool          // the terminal was handed to the process group of this instance, see m.Tty
+}
+
 type Main struct {
 	Opts          opts.Type
-	Cmd           *exec.Cmd
-	StdIn         io.WriteCloser
-	StdOut        io.ReadCloser
-	StdErr        io.ReadCloser
+	Child         *atomic.Pointer[Child] // the current (or last) instance of PROGRAM
+	StdIn         *stdin.Mux
+	StdInEOF      *atomic.Bool // stdin of tea has reached EOF
 	FixedExitCode *atomic.Int32
+	Hooks         *sync.WaitGroup // running --exec commands
+	Done          chan struct{}   // closed when PROGRAM has exited, and it is not restarted anymore
+	Stop          chan struct{}   // closed when tea is stopping, see requestStop
+	StopOnce      *sync.Once
+	Escalating    *atomic.Bool            // a --kill-after escalation is in progress
+	LastOutput    *atomic.Int64           // time of the last line read from PROGRAM, in unix nanoseconds
+	LimitExitCode *atomic.Int32           // exit code set by the supervisor when a limit is exceeded, or 0
+	Vars          *vars.Store             // named variables, shared by all chains
+	State         *atomic.Pointer[string] // the current state, see --goto-state
+	StateMu       *sync.Mutex             // serializes state transitions and writing the state file
+	Seq           *atomic.Int64           // sequence number of the last record written with --output-format
+	LongLine      *atomic.Bool            // a line was dropped by --long-lines fail
+	Group         bool                    // PROGRAM runs in its own process group
+	Tty           *os.File                // the terminal that is handed to the process group of PROGRAM, or nil
 }
 
+// Exit codes used when a global limit is exceeded (see Supervise), or when a line is too long (see ReadLines)
+const (
+	ExitLongLine   = 122
+	ExitMaxIdle    = 123
+	ExitMaxRuntime = 124
+)
+
+// LimitKillAfter is the time after --max-signal, after which PROGRAM is killed when --kill-after does not escalate the
+// signal, so that the global limits are enforced even if PROGRAM ignores --max-signal
+const LimitKillAfter = 10 * time.Second
+
 type Line struct {
 	Value      string
-	InStdErr   bool // the line came from stderr instead of stdout
-	OutStdErr  bool // the line should be written to stderr
+	Number     int       // line number in the input stream, starting from 1
+	Time       time.Time // time when the line was read
+	InStdErr   bool      // the line came from stderr instead of stdout
+	OutStdErr  bool      // the line should be written to stderr
+	Dropped    bool      // the line should not be written to the output
+	Restart    bool      // not a real line, PROGRAM was restarted with --restart-reset, see Chain.reset
+	Stamp      string    // timestamp of the line, see --timestamp
+	Terminator string    // the original line terminator, see lines.Reader
+	Continued  bool      // the line continues the previous one, which had no terminator (see --long-lines split)
+	Split      bool      // the line is continued by the next one, so no suffix is written after it
 	MarkStdOut *string
 	MarkStdErr *string
 	Prefix     *string
-	Suffix     *string
+	Suffix     *string                         // written instead of Terminator, if set
+	parsed     map[fields.Format]fields.Fields // see Line.Fields
+}
+
+// Fields returns the fields of a structured log line, or nil if the line is not in the given format. The line is parsed
+// only once for each format, and the parsed form is shared by all commands that process the line.
+func (l *Line) Fields(format fields.Format) fields.Fields {
+	if l.parsed == nil {
+		l.parsed = make(map[fields.Format]fields.Fields)
+	}
+	f, ok := l.parsed[format]
+	if !ok {
+		f = fields.Parse(l.Value, format)
+		l.parsed[format] = f
+	}
+	return f
 }
 
 type LineChannel = chan Line
 
 var NewLine = "\n"
 
+// TimeFormat is used for the ${time} template variable
+const TimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
 func ListSignals() {
 	// https://stackoverflow.com/questions/42598522/how-can-i-list-available-operating-system-signals-by-name-in-a-cross-platform-wa
 	for i := syscall.Signal(0); i < syscall.Signal(255); i++ {
@@ -77,112 +148,86 @@ func main() {
 		os.Exit(0)
 	}
 
-	cmd := exec.Command(o.Program, o.ProgramArgs...)
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		log.Fatal(err)
-	}
-	m = Main{
-		Opts:          o,
-		Cmd:           cmd,
-		StdIn:         stdin,
-		StdOut:        stdout,
-		StdErr:        stderr,
-		FixedExitCode: &atomic.Int32{},
-	}
-	m.FixedExitCode.Store(-1)
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+	m = CreateMain(o)
+	if m.Group && !o.Pty && !proc.IsControllingTerminal(os.Stdin) {
+		// PROGRAM can only use the terminal in the foreground, but tea must be able to read its stdin
+		m.Tty = proc.ForegroundTerminal()
 	}
+	writeStateFile(o.InitialState)
 
-	if o.PidFile != "" {
-		err = os.WriteFile(o.PidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer func() {
-			err := os.Remove(o.PidFile)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}()
+	// the first instance is started before anything else, so that m.StdIn and m.Child are always set
+	child := StartProgram()
+
+	if o.MaxRuntime != nil || o.MaxIdle != nil {
+		go Supervise()
 	}
 
-	chStdInIn := make(chan string, 1)
-	//go ReadStdIn(os.Stdin, m.Opts.LineBufferSize, chStdInIn)
-	//go WriteData(m.StdIn, chStdInIn, nil)
+	go ForwardStdIn()
 
 	chStdOutOut := make(chan string, 1)
 	chStdErrOut := make(chan string, 1)
 	chStdOutIn := make(LineChannel, 1)
 	chStdErrIn := make(LineChannel, 1)
 
+	chains := make([]*Chain, 0)
+	newChain := func(stdOut bool, stdErr bool) *Chain {
+		chain := &Chain{
+			Commands:    opts.CopyCommands(o.Commands),
+			CmdIdx:      o.CmdIdx,
+			StdOut:      stdOut,
+			StdErr:      stdErr,
+			ChStdOutOut: chStdOutOut,
+			ChStdErrOut: chStdErrOut,
+			ChSignal:    make(chan syscall.Signal, 8),
+		}
+		chains = append(chains, chain)
+		return chain
+	}
+
 	wgProc := sync.WaitGroup{}
 
 	if o.ShareStreams {
-		// share streams: read from stdout and stderr, and put both of them into chStdOutIn
-		wgRead := sync.WaitGroup{}
-		wgRead.Add(2)
-		go ReadLines(m.StdOut, m.Opts.LineBufferSize, false, chStdOutIn, &wgRead)
-		go ReadLines(m.StdErr, m.Opts.LineBufferSize, false, chStdOutIn, &wgRead)
+		// share streams: lines from stdout and stderr are both put into chStdOutIn, only chStdOutIn is used
+		wgProc.Add(1)
+		go newChain(true, false).ProcessLines(chStdOutIn, &wgProc)
+	} else if o.ShareCommands {
+		// Merge chStdOutIn and chStdErrIn into chIn
+		chIn := make(chan Line)
+		wg := sync.WaitGroup{}
+		wg.Add(2)
+		go func() {
+			for line := range chStdOutIn {
+				chIn <- line
+			}
+			wg.Done()
+		}()
 		go func() {
-			wgRead.Wait()
-			close(chStdOutIn)
+			for line := range chStdErrIn {
+				chIn <- line
+			}
+			wg.Done()
+		}()
+		// Wait until both closed, then close chIn
+		go func() {
+			wg.Wait()
+			close(chIn)
 		}()
-		// Only chStdOutIn is used
+		// Process serialized lines with the same command chain
 		wgProc.Add(1)
-		go ProcessLines(&o.Commands, o.CmdIdx, chStdInIn, chStdOutIn, chStdOutOut, chStdErrOut, &wgProc)
+		go newChain(true, true).ProcessLines(chIn, &wgProc)
 	} else {
-		// normal: read from stdout and stderr, and put them into chStdOutIn and chStdErrIn
-		go ReadLines(m.StdOut, m.Opts.LineBufferSize, false, chStdOutIn, nil)
-		go ReadLines(m.StdErr, m.Opts.LineBufferSize, true, chStdErrIn, nil)
-
-		if o.ShareCommands {
-			// Merge chStdOutIn and chStdErrIn into chIn
-			chIn := make(chan Line)
-			wg := sync.WaitGroup{}
-			wg.Add(2)
-			go func() {
-				for line := range chStdOutIn {
-					chIn <- line
-				}
-				wg.Done()
-			}()
-			go func() {
-				for line := range chStdErrIn {
-					chIn <- line
-				}
-				wg.Done()
-			}()
-			// Wait until both closed, then close chIn
-			go func() {
-				wg.Wait()
-				close(chIn)
-			}()
-			// Process serialized lines with the same command chain
-			wgProc.Add(1)
-			go ProcessLines(&o.Commands, o.CmdIdx, chStdInIn, chIn, chStdOutOut, chStdErrOut, &wgProc)
-		} else {
-			// Process stdin and stdout with different command chain instances
-			cmdStdOut := o.Commands
-			cmdStdErr := o.Commands
-			wgProc.Add(2)
-			go ProcessLines(&cmdStdOut, o.CmdIdx, chStdInIn, chStdOutIn, chStdOutOut, chStdErrOut, &wgProc)
-			go ProcessLines(&cmdStdErr, o.CmdIdx, chStdInIn, chStdErrIn, chStdOutOut, chStdErrOut, &wgProc)
-		}
-
+		// Process stdin and stdout with different command chain instances
+		wgProc.Add(2)
+		go newChain(true, false).ProcessLines(chStdOutIn, &wgProc)
+		go newChain(false, true).ProcessLines(chStdErrIn, &wgProc)
 	}
 
+	go HandleSignals(chains)
+
 	go func() {
 		wgProc.Wait()
+		// the output of background --exec commands is written through the same channels
+		m.Hooks.Wait()
 		close(chStdOutOut)
 		close(chStdErrOut)
 	}()
@@ -192,192 +237,1027 @@ func main() {
 	go WriteData(os.Stdout, chStdOutOut, &wgWrite)
 	go WriteData(os.Stderr, chStdErrOut, &wgWrite)
 
+	// The input channels are kept open while PROGRAM is restarted, so the chains and their state survive restarts.
+	restarts := 0
+	var delay time.Duration
+RunLoop:
+	for {
+		wgRead := sync.WaitGroup{}
+		wgRead.Add(2)
+		if o.ShareStreams {
+			go ReadStream(child.StdOut, false, chStdOutIn, &wgRead)
+			go ReadStream(child.StdErr, false, chStdOutIn, &wgRead)
+		} else {
+			go ReadStream(child.StdOut, false, chStdOutIn, &wgRead)
+			go ReadStream(child.StdErr, true, chStdErrIn, &wgRead)
+		}
+		wgRead.Wait()
+		err = child.Cmd.Wait()
+		m.StdIn.Close()
+		// pipes are closed by Wait, but the master side of a pseudo-terminal is not
+		_ = child.StdOut.Close()
+
+		if !wantsRestart(child, err) {
+			break
+		}
+		if o.RestartMax >= 0 && restarts >= o.RestartMax {
+			log.Printf("PROGRAM was restarted %v times, --restart-max reached", restarts)
+			break
+		}
+		// the delay is doubled after each restart, unless PROGRAM was running longer than --restart-max-wait
+		if restarts == 0 || time.Since(child.Started) > o.RestartMaxWait {
+			delay = o.RestartBackoff
+		} else {
+			delay = min(delay*2, o.RestartMaxWait)
+		}
+		restarts++
+		log.Printf("restarting PROGRAM in %v (restart #%v)", delay, restarts)
+		select {
+		case <-time.After(delay):
+		case <-m.Stop:
+			break RunLoop
+		}
+		if o.RestartReset {
+			// a control line is sent through the input channels, so it is processed after the lines of the previous run
+			chStdOutIn <- Line{Restart: true}
+			if !o.ShareStreams && !o.ShareCommands {
+				chStdErrIn <- Line{Restart: true}
+			}
+		}
+		child = StartProgram()
+	}
+	if child.Foreground && proc.IsForeground(m.Tty, child.Cmd.Process.Pid) {
+		// take the terminal back from PROGRAM, the shell expects it in the process group of tea
+		if err := proc.SetForeground(m.Tty, syscall.Getpgrp()); err != nil {
+			log.Printf("cannot take back the terminal: %v", err)
+		}
+	}
+	close(m.Done)
+	close(chStdOutIn)
+	close(chStdErrIn)
+
 	wgWrite.Wait()
-	err = cmd.Wait()
+	m.Hooks.Wait()
+
+	for _, fpath := range []string{o.PidFile, o.StateFile} {
+		if fpath != "" {
+			if err := os.Remove(fpath); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 
 	ec := m.FixedExitCode.Load()
+	if ec < 0 && child.Escalated.Load() > 0 {
+		// the last instance of PROGRAM did not exit in time after a signal action
+		ec = 128 + child.Escalated.Load()
+	}
+	if ec < 0 && err == nil && m.LongLine.Load() {
+		// only when PROGRAM has succeeded, and the exit code was not set by a command
+		ec = ExitLongLine
+	}
+	if m.LimitExitCode.Load() > 0 {
+		// exceeding a global limit takes precedence over everything else
+		ec = m.LimitExitCode.Load()
+	}
 	if ec >= 0 {
 		os.Exit(int(ec))
 	} else {
 		var exitErr *exec.ExitError
 		if errors.As(err, &exitErr) {
 			fmt.Println(exitErr.Error())
-			os.Exit(exitErr.ExitCode())
+			os.Exit(exitCode(exitErr.ProcessState))
 		}
 	}
 }
 
-func ReadLines(reader io.ReadCloser, bufSize int, inStdErr bool, ch LineChannel, wgRead *sync.WaitGroup) {
-	scanner := bufio.NewScanner(reader)
-	buf := make([]byte, bufSize)
-	scanner.Buffer(buf, bufSize)
-	for scanner.Scan() {
-		line := scanner.Text()
-		ch <- Line{line, inStdErr, inStdErr, nil, nil, nil, &NewLine}
-	}
-	if wgRead == nil {
-		close(ch)
-	} else {
-		wgRead.Done()
+// CreateMain creates the state of tea for the given options. PROGRAM is not started.
+func CreateMain(o opts.Type) Main {
+	result := Main{
+		Opts:          o,
+		Child:         &atomic.Pointer[Child]{},
+		StdInEOF:      &atomic.Bool{},
+		FixedExitCode: &atomic.Int32{},
+		Hooks:         &sync.WaitGroup{},
+		Done:          make(chan struct{}),
+		Stop:          make(chan struct{}),
+		StopOnce:      &sync.Once{},
+		Escalating:    &atomic.Bool{},
+		LastOutput:    &atomic.Int64{},
+		LimitExitCode: &atomic.Int32{},
+		Vars:          vars.CreateStore(),
+		State:         &atomic.Pointer[string]{},
+		StateMu:       &sync.Mutex{},
+		Seq:           &atomic.Int64{},
+		LongLine:      &atomic.Bool{},
+		Group:         o.Pty || o.SignalsGroup(),
 	}
+	result.FixedExitCode.Store(-1)
+	result.State.Store(&o.InitialState)
+	result.LastOutput.Store(time.Now().UnixNano())
+	return result
 }
 
-func WriteData(writer io.WriteCloser, ch chan string, wg *sync.WaitGroup) {
-	for line := range ch {
-		_, err := writer.Write([]byte(line))
+// StartProgram starts a new instance of PROGRAM, connects its stdin to m.StdIn, and writes its pid into the pid file.
+func StartProgram() *Child {
+	o := &m.Opts
+	cmd := exec.Command(o.Program, o.ProgramArgs...)
+	var stdinPipe io.WriteCloser
+	var stdout io.ReadCloser
+	var ptySlave *os.File
+	var err error
+	foreground := false
+	if o.Pty {
+		// stdin and stdout of PROGRAM is a pseudo-terminal, stderr is still a pipe
+		master, slave, err := pty.Open()
+		if err != nil {
+			log.Fatal(err)
+		}
+		cmd.Stdin = slave
+		cmd.Stdout = slave
+		// the new session also creates a new process group
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+		stdinPipe = pty.Input{Master: master}
+		stdout = master
+		ptySlave = slave
+	} else {
+		if m.Group {
+			// start PROGRAM in its own process group, so that --signal-group can signal all of its processes
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			if m.Tty != nil && ttyOwned() {
+				// otherwise PROGRAM would be stopped when it reads the terminal (e.g. a password prompt)
+				cmd.SysProcAttr.Foreground = true
+				cmd.SysProcAttr.Ctty = int(m.Tty.Fd())
+				foreground = true
+			}
+		}
+		stdinPipe, err = cmd.StdinPipe()
+		if err != nil {
+			log.Fatal(err)
+		}
+		stdout, err = cmd.StdoutPipe()
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
-	if wg != nil {
-		wg.Done()
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		log.Fatal(err)
 	}
-}
+	if err := cmd.Start(); err != nil {
+		log.Fatal(err)
+	}
+	child := &Child{
+		Cmd:              cmd,
+		StdOut:           stdout,
+		StdErr:           stderr,
+		Started:          time.Now(),
+		Exited:           make(chan struct{}),
+		RestartRequested: &atomic.Bool{},
+		Escalated:        &atomic.Int32{},
+		Foreground:       foreground,
+	}
+	m.Child.Store(child)
+	if foreground {
+		go FollowStops(child)
+	}
+	go func() {
+		if proc.WaitExit(cmd.Process.Pid) == nil {
+			close(child.Exited)
+		}
+	}()
 
-func ProcessLines(commands *[]opts.Command, cmdIndices map[string]int, chStdInIn chan string, chIn LineChannel, chStdOutOut chan string, chStdErrOut chan string, wgProc *sync.WaitGroup) {
-	for cmdIdx := range *commands {
-		(*commands)[cmdIdx].ResetStarted()
+	if m.StdIn == nil {
+		m.StdIn = stdin.CreateMux(stdinPipe, func(err error) {
+			log.Printf("cannot write stdin of PROGRAM: %v", err)
+		})
+	} else {
+		m.StdIn.Reopen(stdinPipe)
+		if m.StdInEOF.Load() && !o.SendsInput() {
+			// stdin of tea has already reached EOF, see ForwardStdIn
+			m.StdIn.Close()
+		}
 	}
 
-	const idleDuration = 1 * time.Second
-	idleTimer := time.NewTimer(idleDuration)
-	defer idleTimer.Stop()
+	if ptySlave != nil {
+		// the slave side must be closed in tea, otherwise reading the master would not stop after PROGRAM exits
+		if err := ptySlave.Close(); err != nil {
+			log.Fatal(err)
+		}
+		go ForwardWindowSize(stdout.(*os.File), child.Exited)
+	}
 
-	lastLineArrived := time.Now()
+	if o.PidFile != "" {
+		// the pid file is rewritten for each instance
+		err = os.WriteFile(o.PidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	return child
+}
 
-ForLoop:
+// ttyOwned tells if the terminal can be handed to a new instance of PROGRAM: tea or the previous instance of PROGRAM
+// is in its foreground process group.
+func ttyOwned() bool {
+	if proc.IsForeground(m.Tty, syscall.Getpgrp()) {
+		return true
+	}
+	prev := m.Child.Load()
+	return prev != nil && prev.Foreground && proc.IsForeground(m.Tty, prev.Cmd.Process.Pid)
+}
+
+// FollowStops stops tea when PROGRAM is stopped in the foreground of the terminal (e.g. by Ctrl+Z), like the shell
+// would have stopped tea itself. The terminal is given back to the shell while tea is stopped, and PROGRAM is
+// continued when tea is continued (e.g. by fg or bg).
+func FollowStops(child *Child) {
+	pid := child.Cmd.Process.Pid
+	chCont := make(chan os.Signal, 1)
+	signal.Notify(chCont, syscall.SIGCONT)
+	defer signal.Stop(chCont)
 	for {
+		stopped, err := proc.WaitStop(pid)
+		if err != nil || !stopped {
+			return
+		}
+		if proc.IsForeground(m.Tty, pid) {
+			if err := proc.SetForeground(m.Tty, syscall.Getpgrp()); err != nil {
+				log.Printf("cannot take back the terminal: %v", err)
+			}
+		}
+		// the process group of tea is stopped, as if the terminal had stopped it
 		select {
-		case line, ok := <-chIn:
-			if !ok {
-				// Channel was closed, exit the loop
-				break ForLoop
+		case <-chCont:
+		default:
+		}
+		_ = syscall.Kill(0, syscall.SIGSTOP)
+		<-chCont
+		if proc.IsForeground(m.Tty, syscall.Getpgrp()) {
+			if err := proc.SetForeground(m.Tty, pid); err != nil {
+				log.Printf("cannot hand the terminal to PROGRAM: %v", err)
 			}
+		}
+		_ = syscall.Kill(-pid, syscall.SIGCONT)
+	}
+}
 
-			processLine(commands, cmdIndices, chStdInIn, line, chStdErrOut, chStdOutOut)
-			lastLineArrived = time.Now()
-
-			// Simple Reset in Go 1.23+ (no manual draining required!)
-			idleTimer.Stop()
-			idleTimer.Reset(idleDuration)
-
-		case <-idleTimer.C:
-			processTimedCommands(commands, cmdIndices, lastLineArrived, chStdInIn, chStdOutOut)
-
-			// Reset timer to wait another second if channel remains idle
-			idleTimer.Reset(idleDuration)
+// wantsRestart tells if PROGRAM should be restarted after it has exited, because of a --restart action or
+// --restart-on-exit. PROGRAM is never restarted when tea is stopping.
+func wantsRestart(child *Child, err error) bool {
+	if stopping() {
+		return false
+	}
+	if child.RestartRequested.Load() {
+		return true
+	}
+	code := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && child.Foreground && ws.Signaled() &&
+			(ws.Signal() == syscall.SIGINT || ws.Signal() == syscall.SIGQUIT) {
+			// PROGRAM was interrupted from the terminal (Ctrl+C), tea did not receive the signal itself
+			requestStop()
+			return false
 		}
+		code = exitCode(exitErr.ProcessState)
+	} else if err != nil {
+		return false
 	}
-	//for line := range chIn {
-	//	processLine(commands, CmdIdx, chStdInIn, line, chStdErrOut, chStdOutOut)
-	//}
-	wgProc.Done()
+	if !m.Opts.RestartOnExit {
+		return false
+	}
+	if len(m.Opts.RestartCodes) == 0 {
+		return code != 0
+	}
+	return slices.Contains(m.Opts.RestartCodes, code)
 }
 
-func processTimedCommands(commands *[]opts.Command, cmdIndices map[string]int, lastLineArrived time.Time, chStdInIn chan string, chStdOutOut chan string) {
-	// go over all commands
-	cmdIdx := 0
-	closeStdIn := false
-	for cmdIdx < len(*commands) {
+// requestStop is called when tea should stop, e.g. it was interrupted or a global limit is exceeded. PROGRAM will not
+// be restarted after it exits.
+func requestStop() {
+	m.StopOnce.Do(func() {
+		close(m.Stop)
+	})
+}
 
-		// eval conditions
+func stopping() bool {
+	select {
+	case <-m.Stop:
+		return true
+	default:
+		return false
+	}
+}
 
-		cmd := (*commands)[cmdIdx]
-		cmdIdx++
+// restartProgram performs --restart. PROGRAM is restarted when it exits. If the command does not send a signal, then
+// --restart-signal is sent to the process group of PROGRAM.
+func restartProgram(a *opts.CommandActions) {
+	if stopping() {
+		return
+	}
+	child := m.Child.Load()
+	child.RestartRequested.Store(true)
+	if a.Signal == nil {
+		r := &opts.CommandActions{Signal: &m.Opts.RestartSignal, SignalTarget: opts.TargetGroup}
+		sendSignal(child, r, *r.Signal)
+		escalate(child, r, *r.Signal)
+	}
+}
 
-		if cmd.Disabled { // skip disabled commands
-			continue
+// Supervise enforces --max-runtime and --max-idle, independently of the command chains. When a limit is exceeded,
+// then --max-signal is sent to the process group of PROGRAM (escalated by --kill-after), and tea will exit with
+// ExitMaxRuntime or ExitMaxIdle.
+func Supervise() {
+	started := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		now := time.Now()
+		var wait time.Duration = -1
+		if m.Opts.MaxRuntime != nil {
+			remaining := started.Add(*m.Opts.MaxRuntime).Sub(now)
+			if remaining <= 0 {
+				stopProgram("--max-runtime", ExitMaxRuntime)
+				return
+			}
+			wait = remaining
+		}
+		if m.Opts.MaxIdle != nil {
+			remaining := time.Unix(0, m.LastOutput.Load()).Add(*m.Opts.MaxIdle).Sub(now)
+			if remaining <= 0 {
+				stopProgram("--max-idle", ExitMaxIdle)
+				return
+			}
+			if wait < 0 || remaining < wait {
+				wait = remaining
+			}
 		}
+		timer.Reset(wait)
+		select {
+		case <-m.Done:
+			return
+		case <-timer.C:
+		}
+	}
+}
 
-		// only --no-input-for-duration is used as a timed command
-		if cmd.Conditions.NoInputForDuration == nil {
-			continue
+// stopProgram is called by the supervisor when a global limit is exceeded.
+func stopProgram(limit string, exitCode int32) {
+	log.Printf("%v exceeded, sending %v to PROGRAM", limit, unix.SignalName(m.Opts.MaxSignal))
+	m.LimitExitCode.Store(exitCode)
+	requestStop()
+	child := m.Child.Load()
+	a := &opts.CommandActions{Signal: &m.Opts.MaxSignal, SignalTarget: opts.TargetGroup}
+	sendSignal(child, a, *a.Signal)
+	if _, ok := m.Opts.NextKillSignal(*a.Signal); ok && m.Opts.KillAfter != nil {
+		escalate(child, a, *a.Signal)
+		return
+	}
+	if *a.Signal == syscall.SIGKILL {
+		return
+	}
+	delay := LimitKillAfter
+	if m.Opts.KillAfter != nil {
+		delay = *m.Opts.KillAfter
+	}
+	go func() {
+		select {
+		case <-child.Exited:
+		case <-time.After(delay):
+			log.Printf("PROGRAM has not exited within %v after %v, sending SIGKILL", delay, limit)
+			sendSignal(child, a, syscall.SIGKILL)
 		}
+	}()
+}
 
-		elapsed := time.Now().Sub(lastLineArrived)
-		if elapsed < *cmd.Conditions.NoInputForDuration {
-			continue
+// HandleSignals receives the signals that are in the signal policy, or used by --on-signal. Signals are forwarded
+// (or translated) to the process group of PROGRAM according to the policy, then they are sent to the chains.
+func HandleSignals(chains []*Chain) {
+	chSignal := make(chan os.Signal, 8)
+	signals := make([]os.Signal, 0)
+	for sig := range m.Opts.SignalPolicy {
+		signals = append(signals, sig)
+	}
+	for _, cmd := range m.Opts.Commands {
+		if cmd.Conditions.OnSignal != nil {
+			signals = append(signals, *cmd.Conditions.OnSignal)
+		}
+	}
+	if m.Tty != nil {
+		signals = append(signals, syscall.SIGTSTP)
+	}
+	signal.Notify(chSignal, signals...)
+	for s := range chSignal {
+		sig := s.(syscall.Signal)
+		child := m.Child.Load()
+		_, inPolicy := m.Opts.SignalPolicy[sig]
+		if target := m.Opts.SignalPolicy[sig]; target != 0 {
+			if isTerminating(target) {
+				// PROGRAM is not restarted after it was interrupted (but a translated signal may only reload it)
+				requestStop()
+			}
+			pid := child.Cmd.Process.Pid
+			if m.Group {
+				pid = -pid
+			}
+			if !m.Group && target == sig && (sig == syscall.SIGINT || sig == syscall.SIGQUIT) && proc.InForeground() {
+				// PROGRAM shares the process group of tea, so the terminal has sent the signal to PROGRAM too (Ctrl+C)
+			} else if err := syscall.Kill(pid, target); err != nil && !errors.Is(err, syscall.ESRCH) {
+				// PROGRAM may have already exited
+				log.Printf("cannot forward signal %v: %v", unix.SignalName(sig), err)
+			}
+		} else if sig == syscall.SIGTSTP && !inPolicy {
+			if child.Foreground {
+				// tea is stopped by FollowStops when PROGRAM has stopped
+				_ = syscall.Kill(-child.Cmd.Process.Pid, syscall.SIGTSTP)
+			} else {
+				_ = syscall.Kill(0, syscall.SIGSTOP)
+			}
+		}
+		for _, chain := range chains {
+			select {
+			case chain.ChSignal <- sig:
+			default:
+				// the chain has finished, or it is busy
+			}
 		}
+	}
+}
 
-		// process actions
-		a := cmd.Actions
+// isTerminating tells if a signal would terminate PROGRAM if it was started directly, see the default signal policy.
+func isTerminating(sig syscall.Signal) bool {
+	return sig == syscall.SIGINT || sig == syscall.SIGTERM || sig == syscall.SIGHUP || sig == syscall.SIGQUIT
+}
 
-		if a.Signal != nil {
-			if err := syscall.Kill(m.Cmd.Process.Pid, *a.Signal); err != nil {
-				log.Fatal(err)
+// ForwardWindowSize sets the window size of the pseudo-terminal of PROGRAM to the size of tea's terminal, and updates
+// it whenever tea receives SIGWINCH, until PROGRAM exits.
+func ForwardWindowSize(master *os.File, exited chan struct{}) {
+	chWinch := make(chan os.Signal, 1)
+	signal.Notify(chWinch, syscall.SIGWINCH)
+	defer signal.Stop(chWinch)
+	for {
+		for _, f := range []*os.File{os.Stdin, os.Stdout, os.Stderr} {
+			if err := pty.InheritSize(master, f); err == nil {
+				break
 			}
 		}
-
-		if a.Input != nil {
-			chStdInIn <- *a.Input
+		select {
+		case <-chWinch:
+		case <-exited:
+			return
 		}
+	}
+}
 
-		if a.InputFile != nil {
-			log.Fatal("--send-input-file not yet implemented, need to refactor ForwardStdIn")
+// ForwardStdIn forwards the stdin of tea to PROGRAM. When stdin reaches EOF, then stdin of PROGRAM is closed, unless
+// there are commands that can send input to PROGRAM. In that case, it is kept open until --close is performed.
+func ForwardStdIn() {
+	err := m.StdIn.Forward(os.Stdin, m.Opts.LineBufferSize)
+	if err != nil {
+		if !errors.Is(err, stdin.ErrClosed) && !errors.Is(err, syscall.EPIPE) {
+			log.Printf("cannot forward stdin: %v", err)
 		}
+		return
+	}
+	m.StdInEOF.Store(true)
+	if !m.Opts.SendsInput() {
+		m.StdIn.Close()
+	}
+}
 
-		if a.CloseStdIn {
-			closeStdIn = true
-		}
+// sendInput queues data to be written to the stdin of PROGRAM. A closed stdin is not a fatal error, because PROGRAM
+// may have already exited.
+func sendInput(data []byte) {
+	if _, err := m.StdIn.Write(data); err != nil {
+		log.Printf("cannot send input: %v", err)
+	}
+}
 
-		if a.SetExitCode != nil {
-			m.FixedExitCode.Store(*a.SetExitCode)
-		}
+// sendInputFile streams the contents of a file to the stdin of PROGRAM. The file is not loaded into memory, and it is
+// copied by the writer goroutine of m.StdIn, so the chain keeps reading the output of PROGRAM in the meantime.
+func sendInputFile(fpath string) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		log.Printf("--send-input-file: cannot open input file: %v", err)
+		return
+	}
+	if err := m.StdIn.WriteFrom(f); err != nil {
+		log.Printf("--send-input-file: cannot send %v: %v", fpath, err)
+	}
+}
 
-		if a.ClearExitCode {
-			m.FixedExitCode.Store(-1)
-		}
+// ReadStream reads the lines of an output stream of PROGRAM into ch. When records are used, then the lines are grouped
+// into records before they are sent to ch, see AssembleRecords.
+func ReadStream(reader io.ReadCloser, inStdErr bool, ch LineChannel, wgRead *sync.WaitGroup) {
+	defer wgRead.Done()
+	if !m.Opts.Records() {
+		ReadLines(reader, m.Opts.LineBufferSize, inStdErr, ch)
+		return
+	}
+	chLines := make(LineChannel, 1)
+	go func() {
+		ReadLines(reader, m.Opts.LineBufferSize, inStdErr, chLines)
+		close(chLines)
+	}()
+	AssembleRecords(chLines, ch)
+}
 
-		for _, n := range a.Disable {
-			i, ok := cmdIndices[n]
-			if !ok {
-				log.Fatal(fmt.Errorf("inernal error: --disable references to non-existent command %v", n))
+func ReadLines(reader io.ReadCloser, bufSize int, inStdErr bool, ch LineChannel) {
+	lineReader := lines.CreateReader(reader, bufSize, m.Opts.CRLines, m.Opts.PromptTimeout)
+	number := 0
+	started := m.Child.Load().Started
+	var previous time.Time
+	continued := false
+	for {
+		value, terminator, err := lineReader.Read()
+		split := false
+		if errors.Is(err, lines.ErrTooLong) {
+			switch m.Opts.LongLines {
+			case "split":
+				// the rest is read as the next line, and it is continued in the output
+				split = true
+			case "truncate":
+				terminator = lineReader.Discard()
+				log.Printf("line %v of %v is longer than %v bytes, it was truncated", number+1, streamName(inStdErr), bufSize)
+			default:
+				lineReader.Discard()
+				number++
+				m.LongLine.Store(true)
+				log.Printf("line %v of %v is longer than %v bytes, it was dropped", number, streamName(inStdErr), bufSize)
+				continue
 			}
-			(*commands)[i].Disabled = true
+		} else if errors.Is(err, lines.ErrPartial) {
+			// a prompt, the rest of the line is read after the input of PROGRAM
+			split = true
+		} else if err != nil {
+			return
 		}
-
-		for _, n := range a.Enable {
-			i, ok := cmdIndices[n]
-			if !ok {
-				log.Fatal(fmt.Errorf("internal error: --enable references to non-existent command %v", n))
+		number++
+		now := time.Now()
+		m.LastOutput.Store(now.UnixNano())
+		line := Line{Value: value, Terminator: terminator, Continued: continued, Split: split, Number: number,
+			Time: now, InStdErr: inStdErr, OutStdErr: inStdErr}
+		continued = split
+		if m.Opts.Timestamp != "" {
+			// lines are stamped when they are read, the stamp is the default prefix of text output
+			line.Stamp = stamp(now, started, previous)
+			if m.Opts.OutputFormat == "text" {
+				prefix := line.Stamp + " "
+				line.Prefix = &prefix
 			}
-			(*commands)[i].Disabled = false
+			previous = now
 		}
+		ch <- line
+	}
+}
 
-		for _, n := range a.Toggle {
-			i, ok := cmdIndices[n]
-			if !ok {
-				log.Fatal(fmt.Errorf("inernal error: --toggle references to non-existent command %v", n))
-			}
-			(*commands)[i].Disabled = !(*commands)[i].Disabled
+// stamp returns the timestamp of a line that was read at now, see --timestamp. started is the start of PROGRAM,
+// previous is the time of the previous line of the same stream (zero for the first line).
+func stamp(now time.Time, started time.Time, previous time.Time) string {
+	switch m.Opts.Timestamp {
+	case "elapsed":
+		return fmt.Sprintf("%.3fs", now.Sub(started).Seconds())
+	case "delta":
+		if previous.IsZero() {
+			previous = started
 		}
+		return fmt.Sprintf("+%.3fs", now.Sub(previous).Seconds())
+	}
+	return now.Format(m.Opts.TimestampFmt)
+}
 
-		if a.NextLine {
-			break
+// AssembleRecords groups lines into multi-line records. A line that matches --record-start starts a new record. Other
+// lines are appended to the current record, unless --record-continue is given and the line does not match it. A record
+// is sent to chOut when the next record starts, when no line is appended within --record-timeout, when it would be
+// longer than --line-buffer-size, or when chIn is closed. The lines of a record are joined with their original
+// terminators, the Number and Time of the record are the ones of its first line, the Terminator (and Split) is the one
+// of its last line.
+func AssembleRecords(chIn LineChannel, chOut LineChannel) {
+	o := &m.Opts
+	var record *Line
+	var parts strings.Builder
+	terminator := ""
+	split := false
+	size := 0
+	timer := time.NewTimer(o.RecordTimeout)
+	timer.Stop()
+	defer timer.Stop()
+	flush := func() {
+		if record != nil {
+			record.Value = parts.String()
+			record.Terminator = terminator
+			record.Split = split
+			chOut <- *record
+			record, size = nil, 0
+			parts.Reset()
 		}
-
-		if a.SkipTo != nil {
-			i, ok := cmdIndices[*a.SkipTo]
+	}
+	for {
+		select {
+		case line, ok := <-chIn:
 			if !ok {
-				log.Fatal(fmt.Errorf("inernal error: --skip-to references to non-existent command %v", a.SkipTo))
+				flush()
+				return
 			}
-			cmdIdx = i
-			continue
+			starts := o.RecordStart != nil && o.RecordStart.MatchString(line.Value)
+			if !starts && o.RecordContinue != nil {
+				starts = !o.RecordContinue.MatchString(line.Value)
+			}
+			if record == nil || starts || size+len(line.Value) > o.LineBufferSize {
+				flush()
+				record = &line
+			}
+			if size > 0 {
+				parts.WriteString(terminator)
+			}
+			parts.WriteString(line.Value)
+			terminator = line.Terminator
+			split = line.Split
+			size += len(line.Value) + 1
+			timer.Reset(o.RecordTimeout)
+		case <-timer.C:
+			flush()
 		}
-
 	}
+}
 
-	if closeStdIn {
-		if err := m.StdIn.Close(); err != nil {
+func WriteData(writer io.WriteCloser, ch chan string, wg *sync.WaitGroup) {
+	for line := range ch {
+		_, err := writer.Write([]byte(line))
+		if err != nil {
 			log.Fatal(err)
 		}
 	}
-
-}
-
-func processLine(commands *[]opts.Command, cmdIndices map[string]int, chStdInIn chan string, line Line, chStdErrOut chan string, chStdOutOut chan string) {
+	if wg != nil {
+		wg.Done()
+	}
+}
+
+// Chain is an instance of the command chain. It processes lines from one or more input streams, and keeps the state
+// of its commands. When neither --share-streams nor --share-commands is given, then there is a separate chain for
+// stdout and for stderr.
+type Chain struct {
+	Commands    []opts.Command
+	CmdIdx      map[string]int
+	StdOut      bool // the chain processes lines read from stdout
+	StdErr      bool // the chain processes lines read from stderr
+	ChStdOutOut chan string
+	ChStdErrOut chan string
+	ChSignal    chan syscall.Signal // signals received by tea, for --on-signal
+}
+
+// watches tells if the command's input source filter selects any of the streams processed by this chain. Time based
+// events of a command are only processed by the chains that are watching its streams.
+func (ch *Chain) watches(cmd *opts.Command) bool {
+	return (ch.StdOut && cmd.Conditions.StdOut) || (ch.StdErr && cmd.Conditions.StdErr)
+}
+
+func (ch *Chain) ProcessLines(chIn LineChannel, wgProc *sync.WaitGroup) {
+	for cmdIdx := range ch.Commands {
+		ch.Commands[cmdIdx].ResetStarted()
+	}
+
+	const idleDuration = 1 * time.Second
+	idleTimer := time.NewTimer(idleDuration)
+	defer idleTimer.Stop()
+
+	// deadlineTimer fires when the nearest --timeout, --or-timeout or --min-match-time is reached
+	deadlineTimer := time.NewTimer(idleDuration)
+	defer deadlineTimer.Stop()
+	ch.resetDeadlineTimer(deadlineTimer)
+
+	lastLineArrived := time.Now()
+
+ForLoop:
+	for {
+		select {
+		case line, ok := <-chIn:
+			if !ok {
+				// Channel was closed, exit the loop
+				break ForLoop
+			}
+			if line.Restart {
+				ch.reset()
+				lastLineArrived = time.Now()
+				ch.resetDeadlineTimer(deadlineTimer)
+				continue
+			}
+
+			ch.processLine(line)
+			lastLineArrived = time.Now()
+
+			// Simple Reset in Go 1.23+ (no manual draining required!)
+			idleTimer.Stop()
+			idleTimer.Reset(idleDuration)
+			ch.resetDeadlineTimer(deadlineTimer)
+
+		case <-idleTimer.C:
+			ch.processTimedCommands(lastLineArrived, timedEvent{idle: true})
+			ch.resetDeadlineTimer(deadlineTimer)
+
+			// Reset timer to wait another second if channel remains idle
+			idleTimer.Reset(idleDuration)
+
+		case <-deadlineTimer.C:
+			ch.processTimedCommands(lastLineArrived, timedEvent{})
+			ch.resetDeadlineTimer(deadlineTimer)
+
+		case sig := <-ch.ChSignal:
+			ch.processTimedCommands(lastLineArrived, timedEvent{signal: sig})
+			ch.resetDeadlineTimer(deadlineTimer)
+		}
+	}
+	wgProc.Done()
+}
+
+// resetDeadlineTimer sets the timer to the nearest pending deadline of the enabled commands, or stops the timer if
+// there is no pending deadline.
+func (ch *Chain) resetDeadlineTimer(t *time.Timer) {
+	t.Stop()
+	var nearest *time.Time
+	for cmdIdx := range ch.Commands {
+		cmd := &ch.Commands[cmdIdx]
+		if cmd.Disabled || !ch.watches(cmd) {
+			continue
+		}
+		deadline, ok := cmd.PendingDeadline()
+		if !ok {
+			continue
+		}
+		if nearest == nil || deadline.Before(*nearest) {
+			nearest = &deadline
+		}
+	}
+	if nearest != nil {
+		t.Reset(max(time.Until(*nearest), 0))
+	}
+}
+
+// timedEvent is the reason for processing commands between lines
+type timedEvent struct {
+	idle   bool           // there was no input for a second, --no-input-for-duration is only evaluated in this case
+	signal syscall.Signal // tea has received this signal (for --on-signal), or 0
+}
+
+// processTimedCommands evaluates time based conditions and --on-signal between lines.
+func (ch *Chain) processTimedCommands(lastLineArrived time.Time, ev timedEvent) {
+	now := time.Now()
+	// go over all commands
+	cmdIdx := 0
+	deferred := deferredActions{}
+	for cmdIdx < len(ch.Commands) {
+
+		// eval conditions
+
+		cmd := &ch.Commands[cmdIdx]
+		cmdIdx++
+
+		if cmd.Disabled { // skip disabled commands
+			continue
+		}
+
+		if !ch.watches(cmd) { // timed events are processed by chains watching the command's streams
+			continue
+		}
+
+		if !varsMatch(cmd) || !stateMatch(cmd) {
+			continue
+		}
+
+		if cmd.Conditions.OnSignal != nil {
+			if *cmd.Conditions.OnSignal != ev.signal {
+				continue
+			}
+		} else if cmd.Conditions.NoInputForDuration != nil {
+			if !ev.idle {
+				continue
+			}
+			elapsed := now.Sub(lastLineArrived)
+			if elapsed < *cmd.Conditions.NoInputForDuration {
+				continue
+			}
+		} else if cmd.HasTimeout() {
+			if !timeoutEventMatch(cmd, now) {
+				continue
+			}
+		} else if cmd.Conditions.MinMatchTime != nil {
+			if !minMatchEventMatch(cmd, now) {
+				continue
+			}
+		} else if cmd.HasRate() {
+			if !rateUpdate(cmd, now) {
+				continue
+			}
+		} else {
+			continue
+		}
+		if !countMatch(cmd) {
+			continue
+		}
+
+		// process actions
+		cmdIdx = ch.processActions(cmd.Actions, &templateVars{chain: ch, cmd: cmd}, cmdIdx, &deferred)
+	}
+
+	ch.processStateHooks(&deferred)
+	deferred.perform()
+
+}
+
+// deferredActions are collected while processing the commands, and they are performed after all commands have been
+// processed.
+type deferredActions struct {
+	inputFile   *string
+	closeStdIn  bool
+	transitions []stateTransition // state transitions whose hooks have not been run yet
+}
+
+// stateTransition is a change of the current state, see --goto-state
+type stateTransition struct {
+	from string
+	to   string
+}
+
+// perform performs the deferred actions: the input file is sent before stdin is closed.
+func (d *deferredActions) perform() {
+	if d.inputFile != nil {
+		sendInputFile(*d.inputFile)
+	}
+	if d.closeStdIn {
+		m.StdIn.Close()
+	}
+}
+
+// processActions performs the actions of a command that do not need a current line. It returns the index of the next
+// command to be processed.
+func (ch *Chain) processActions(a *opts.CommandActions, vars *templateVars, cmdIdx int, deferred *deferredActions) int {
+	if a.Restart {
+		restartProgram(a)
+	}
+
+	if a.Signal != nil {
+		child := m.Child.Load()
+		sendSignal(child, a, *a.Signal)
+		escalate(child, a, *a.Signal)
+	}
+
+	if a.Input != nil {
+		sendInput([]byte(vars.expand(a.CompiledInput)))
+	}
+
+	if a.InputFile != nil {
+		deferred.inputFile = a.InputFile
+	}
+
+	if a.Exec != nil {
+		ch.runHook(a, vars)
+	}
+
+	if a.CloseStdIn {
+		deferred.closeStdIn = true
+	}
+
+	if a.SetExitCode != nil {
+		m.FixedExitCode.Store(*a.SetExitCode)
+	}
+
+	if a.ClearExitCode {
+		m.FixedExitCode.Store(-1)
+	}
+
+	for _, n := range a.Disable {
+		i, ok := ch.CmdIdx[n]
+		if !ok {
+			log.Fatal(fmt.Errorf("inernal error: --disable references to non-existent command %v", n))
+		}
+		ch.Commands[i].Disabled = true
+	}
+
+	for _, n := range a.Enable {
+		i, ok := ch.CmdIdx[n]
+		if !ok {
+			log.Fatal(fmt.Errorf("internal error: --enable references to non-existent command %v", n))
+		}
+		ch.enable(i)
+	}
+
+	for _, n := range a.Toggle {
+		i, ok := ch.CmdIdx[n]
+		if !ok {
+			log.Fatal(fmt.Errorf("inernal error: --toggle references to non-existent command %v", n))
+		}
+		if ch.Commands[i].Disabled {
+			ch.enable(i)
+		} else {
+			ch.Commands[i].Disabled = true
+		}
+	}
+
+	for _, n := range a.ResetCount {
+		i, ok := ch.CmdIdx[n]
+		if !ok {
+			log.Fatal(fmt.Errorf("internal error: --reset-count references to non-existent command %v", n))
+		}
+		ch.Commands[i].Count = 0
+	}
+
+	for _, assignment := range a.SetVar {
+		m.Vars.Set(assignment.Name, vars.expand(assignment.CompiledValue))
+	}
+
+	for _, name := range a.IncrVar {
+		m.Vars.Incr(name)
+	}
+
+	for _, name := range a.UnsetVar {
+		m.Vars.Unset(name)
+	}
+
+	if a.GotoState != nil {
+		if from, changed := setState(*a.GotoState); changed {
+			deferred.transitions = append(deferred.transitions, stateTransition{from: from, to: *a.GotoState})
+		}
+	}
+
+	if a.NextLine {
+		return len(ch.Commands)
+	}
+
+	if a.SkipTo != nil {
+		i, ok := ch.CmdIdx[*a.SkipTo]
+		if !ok {
+			log.Fatal(fmt.Errorf("inernal error: --skip-to references to non-existent command %v", a.SkipTo))
+		}
+		return i
+	}
+
+	return cmdIdx
+}
+
+// maxTransitions limits the number of state transitions performed by the hooks of a single line (or event)
+const maxTransitions = 100
+
+// processStateHooks runs the --on-exit hooks of the old state, and then the --on-enter hooks of the new state for each
+// state transition. Hooks are run by the chain that has performed the transition, and they may perform further
+// transitions.
+func (ch *Chain) processStateHooks(deferred *deferredActions) {
+	for n := 0; len(deferred.transitions) > 0; n++ {
+		if n == maxTransitions {
+			log.Printf("more than %v state transitions, the hooks of --on-enter and --on-exit are probably looping", n)
+			deferred.transitions = nil
+			return
+		}
+		t := deferred.transitions[0]
+		deferred.transitions = deferred.transitions[1:]
+		for _, enter := range []bool{false, true} {
+			cmdIdx := 0
+			for cmdIdx < len(ch.Commands) {
+				cmd := &ch.Commands[cmdIdx]
+				cmdIdx++
+				if cmd.Disabled || !varsMatch(cmd) || !stateMatch(cmd) {
+					continue
+				}
+				c := cmd.Conditions
+				if enter && (c.OnEnter == nil || *c.OnEnter != t.to) {
+					continue
+				}
+				if !enter && (c.OnExit == nil || *c.OnExit != t.from) {
+					continue
+				}
+				if !countMatch(cmd) {
+					continue
+				}
+				cmdIdx = ch.processActions(cmd.Actions, &templateVars{chain: ch, cmd: cmd}, cmdIdx, deferred)
+			}
+		}
+	}
+}
+
+// reset restores the initial state of the commands, when PROGRAM is restarted with --restart-reset. The initial state
+// is also restored, without running the hooks.
+func (ch *Chain) reset() {
+	setState(m.Opts.InitialState)
+	ch.Commands = opts.CopyCommands(m.Opts.Commands)
+	for cmdIdx := range ch.Commands {
+		ch.Commands[cmdIdx].ResetStarted()
+	}
+}
+
+// enable enables a command. When a disabled command becomes enabled, then its time based conditions are restarted,
+// e.g. a deadline that has passed while the command was disabled will not fire.
+func (ch *Chain) enable(cmdIdx int) {
+	cmd := &ch.Commands[cmdIdx]
+	if cmd.Disabled {
+		cmd.Disabled = false
+		cmd.ResetStarted()
+	}
+}
+
+func (ch *Chain) processLine(line Line) {
+	now := time.Now()
 	// Perform LineEnabled / LineDisabled at the beginning of the line
-	for _, cmd := range *commands {
+	for cmdIdx := range ch.Commands {
+		cmd := &ch.Commands[cmdIdx]
 		if cmd.LineEnabled {
 			cmd.Disabled = false
 		} else if cmd.LineDisabled {
@@ -386,17 +1266,18 @@ func processLine(commands *[]opts.Command, cmdIndices map[string]int, chStdInIn
 	}
 	// go over all commands
 	cmdIdx := 0
-	closeStdIn := false
+	deferred := deferredActions{}
 	var clr *color.Color = nil
-	for cmdIdx < len(*commands) {
+	matched := make([]string, 0) // names of the commands that have matched the line, for --output-format
+	for cmdIdx < len(ch.Commands) {
 
 		// eval conditions
 
-		cmd := (*commands)[cmdIdx]
+		cmd := &ch.Commands[cmdIdx]
 		cmdIdx++
 
-		// --no-input-for-duration is not used in line processing, it is a timed command
-		if cmd.Conditions.NoInputForDuration != nil {
+		// --no-input-for-duration and --on-signal are not used in line processing, they are events
+		if cmd.IsEvent() {
 			continue
 		}
 
@@ -409,44 +1290,46 @@ func processLine(commands *[]opts.Command, cmdIndices map[string]int, chStdInIn
 		if !line.InStdErr && !cmd.Conditions.StdOut { // skip by input source filter
 			continue
 		}
+		if !varsMatch(cmd) || !stateMatch(cmd) { // tested before anything else, like the disabled state
+			continue
+		}
 		// pattern matching
-		if !commandLineMatch(&line, &cmd) {
+		isMatch := commandLineMatch(&line, cmd) && fieldsMatch(&line, cmd)
+		cmd.LastMatch = isMatch
+		// time based conditions
+		if cmd.HasTimeout() {
+			isMatch = timeoutLineMatch(cmd, isMatch, now)
+		} else if cmd.Conditions.MinMatchTime != nil {
+			isMatch = minMatchLineMatch(cmd, isMatch, now)
+		} else if cmd.HasRate() {
+			isMatch = rateLineMatch(cmd, isMatch, now)
+		}
+		if !isMatch || !countMatch(cmd) {
 			continue
 		}
-		/* TODO: process time based conditions
-
-		AndTimeout         *time.Duration
-		OrTimeout          *time.Duration
-		MinMatchTime       *time.Duration
-
-		The AndTimeout and OrTimeout could be implemented using a special Line object, that has nil line Value.
-		and emitted when the timeout is reached. The ProcessLines() method should save the "last match state"
-		of each command, and process these special lines using the "last match state" as the condition.
-
-		Steps to implement:
-
-		1. Make Line.value *string instead of string
-		2. Add command index reference Line.cmdIdx
-		3. When processing starts, create a new go routine for each command with a timeout, and emit a special
-		   line(s) when the timeout is reached. The emission target can be std-out-in or std-err-in, depending
-		   on the command's settings.
-		4. Rewrite ProcessLines, detect these special lines and treat them as timeout events. Process the action
-		   if the timeout has come, and the last state is "matched".
-		5. Think over what should happen when a timeout based command is enabled AFTER its timeout has come.
-		   Should the "enable" operation trigger its actions immediately or not?
-
-		The above should work for AndTimeout and OrTimeout. Test this, and only after that should we implement
-		MinMatchTime, MaxMatchTime, InputForDuration.
-
-		*/
+		if cmd.Name != "" {
+			matched = append(matched, cmd.Name)
+		} else {
+			matched = append(matched, fmt.Sprintf("#%d", cmdIdx))
+		}
 
 		// process actions
 		a := cmd.Actions
+		vars := &templateVars{chain: ch, cmd: cmd, line: &line}
+		if len(a.Replace) > 0 {
+			// groups of the patterns refer to the line before the replacement
+			vars.matchGroups()
+			for _, r := range a.Replace {
+				line.Value = replaceLine(line.Value, &r)
+			}
+			// the rewritten line is parsed again, when needed
+			line.parsed = nil
+		}
 		if a.MarkStdOut != nil {
-			line.MarkStdOut = a.MarkStdOut
+			line.MarkStdOut = vars.expandP(a.CompiledMarkStdOut)
 		}
 		if a.MarkStdErr != nil {
-			line.MarkStdErr = a.MarkStdErr
+			line.MarkStdErr = vars.expandP(a.CompiledMarkStdErr)
 		}
 		if a.SendToStdOut {
 			line.OutStdErr = false
@@ -454,119 +1337,631 @@ func processLine(commands *[]opts.Command, cmdIndices map[string]int, chStdInIn
 		if a.SendToStdErr {
 			line.OutStdErr = true
 		}
+		if a.Drop {
+			line.Dropped = true
+		}
 		if a.SetPrefix != nil {
-			line.Prefix = a.SetPrefix
+			line.Prefix = vars.expandP(a.CompiledSetPrefix)
 		}
 		if a.SetSuffix != nil {
-			line.Suffix = a.SetSuffix
+			line.Suffix = vars.expandP(a.CompiledSetSuffix)
 		}
 		if a.Color != nil {
 			clr = a.Color
 		}
 
-		if a.Signal != nil {
-			if err := syscall.Kill(m.Cmd.Process.Pid, *a.Signal); err != nil {
-				log.Fatal(err)
-			}
-		}
+		cmdIdx = ch.processActions(a, vars, cmdIdx, &deferred)
+	}
+
+	ch.processStateHooks(&deferred)
+	deferred.perform()
 
-		if a.Input != nil {
-			chStdInIn <- *a.Input
+	if line.Dropped {
+		return
+	}
+
+	if m.Opts.OutputFormat != "text" {
+		ch.writeRecord(&line, matched)
+		return
+	}
+
+	// Sprint instead of Sprintf, because lines and expanded templates may contain % characters
+	var format = func(s string) string {
+		return s
+	}
+	if clr != nil {
+		sprint := clr.SprintFunc()
+		format = func(s string) string {
+			return sprint(s)
 		}
+	}
 
-		if a.InputFile != nil {
-			log.Fatal("--send-input-file not yet implemented, need to refactor ForwardStdIn")
+	// the pieces of a split line are written as a single line, with the prefix before the first piece, and the suffix
+	// after the last one
+	if line.OutStdErr {
+		if line.MarkStdErr != nil {
+			ch.ChStdErrOut <- format(*line.MarkStdErr)
+		} else {
+			if line.Prefix != nil && !line.Continued {
+				ch.ChStdErrOut <- format(*line.Prefix)
+			}
+			ch.ChStdErrOut <- line.Value
+			if line.Suffix != nil && !line.Split {
+				ch.ChStdErrOut <- format(*line.Suffix)
+			} else {
+				ch.ChStdErrOut <- line.Terminator
+			}
+		}
+	} else {
+		if line.MarkStdOut != nil {
+			ch.ChStdOutOut <- format(*line.MarkStdOut)
+		} else {
+			if line.Prefix != nil && !line.Continued {
+				ch.ChStdOutOut <- format(*line.Prefix)
+			}
+			ch.ChStdOutOut <- format(line.Value)
+			if line.Suffix != nil && !line.Split {
+				ch.ChStdOutOut <- format(*line.Suffix)
+			} else {
+				ch.ChStdOutOut <- line.Terminator
+			}
 		}
 
-		if a.CloseStdIn {
-			closeStdIn = true
+	}
+}
+
+// varsMatch evaluates the --if, --if-set and --if-unset conditions of the command.
+func varsMatch(cmd *opts.Command) bool {
+	for _, cond := range cmd.Conditions.Vars {
+		value, ok := m.Vars.Get(cond.Name)
+		switch cond.Op {
+		case opts.VarEquals:
+			ok = ok && value == cond.Value
+		case opts.VarNotEquals:
+			ok = !ok || value != cond.Value
+		case opts.VarUnset:
+			ok = !ok
+		}
+		if !ok {
+			return false
 		}
+	}
+	return true
+}
+
+// stateMatch evaluates the --in-state conditions of the command.
+func stateMatch(cmd *opts.Command) bool {
+	return len(cmd.Conditions.InState) == 0 || slices.Contains(cmd.Conditions.InState, *m.State.Load())
+}
+
+// setState switches to a new state, and writes it into the state file. It returns the previous state, and false if
+// the state has not changed.
+func setState(state string) (string, bool) {
+	m.StateMu.Lock()
+	defer m.StateMu.Unlock()
+	from := *m.State.Load()
+	if from == state {
+		return from, false
+	}
+	m.State.Store(&state)
+	writeStateFile(state)
+	return from, true
+}
+
+// writeStateFile writes the current state into the --state-file.
+func writeStateFile(state string) {
+	if m.Opts.StateFile == "" {
+		return
+	}
+	if err := os.WriteFile(m.Opts.StateFile, []byte(state), 0644); err != nil {
+		log.Printf("--state-file: %v", err)
+	}
+}
 
-		if a.SetExitCode != nil {
-			m.FixedExitCode.Store(*a.SetExitCode)
+// fieldsMatch evaluates the field conditions of the command. A missing field, or a line that is not in the format of
+// the command, does not match.
+func fieldsMatch(l *Line, cmd *opts.Command) bool {
+	if len(cmd.Conditions.Fields) == 0 {
+		return true
+	}
+	f := l.Fields(cmd.Conditions.FieldFormat)
+	for _, cond := range cmd.Conditions.Fields {
+		value, ok := f[cond.Key]
+		if !ok {
+			return false
+		}
+		switch cond.Op {
+		case opts.FieldEquals:
+			ok = value == cond.Value
+		case opts.FieldMatches:
+			ok = cond.Pattern.MatchString(value)
+		case opts.FieldGreater, opts.FieldLess:
+			n, err := strconv.ParseFloat(value, 64)
+			ok = err == nil && (cond.Op == opts.FieldGreater && n > cond.Number || cond.Op == opts.FieldLess && n < cond.Number)
 		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// countMatch counts a match of the command, and evaluates --min-count, --max-count and --every. It tells if the
+// command should fire for this match.
+func countMatch(cmd *opts.Command) bool {
+	cmd.Count++
+	c := cmd.Conditions
+	if c.MinCount != nil && cmd.Count < *c.MinCount {
+		return false
+	}
+	if c.MaxCount != nil && cmd.Count > *c.MaxCount {
+		return false
+	}
+	if c.Every != nil && cmd.Count%*c.Every != 0 {
+		return false
+	}
+	return true
+}
+
+func streamName(stderr bool) string {
+	if stderr {
+		return "stderr"
+	}
+	return "stdout"
+}
+
+// writeRecord writes a line as a structured record, see --output-format. Colors are not applied.
+func (ch *Chain) writeRecord(line *Line, matched []string) {
+	record := []fields.Field{
+		{Key: "seq", Value: m.Seq.Add(1)},
+		{Key: "time", Value: line.Time.Format(TimeFormat)},
+		{Key: "stream", Value: streamName(line.InStdErr)},
+		{Key: "output", Value: streamName(line.OutStdErr)},
+		{Key: "lineno", Value: line.Number},
+		{Key: "commands", Value: matched},
+	}
+	mark := line.MarkStdOut
+	if line.OutStdErr {
+		mark = line.MarkStdErr
+	}
+	if mark != nil {
+		record = append(record, fields.Field{Key: "mark", Value: *mark})
+	}
+	if line.Prefix != nil {
+		record = append(record, fields.Field{Key: "prefix", Value: *line.Prefix})
+	}
+	if line.Suffix != nil {
+		record = append(record, fields.Field{Key: "suffix", Value: *line.Suffix})
+	}
+	if line.Stamp != "" {
+		record = append(record, fields.Field{Key: "timestamp", Value: line.Stamp})
+	}
+	record = append(record, fields.Field{Key: "line", Value: line.Value})
 
-		if a.ClearExitCode {
-			m.FixedExitCode.Store(-1)
+	var s string
+	if m.Opts.OutputFormat == "json" {
+		s = fields.WriteJSON(record)
+	} else {
+		s = fields.WriteLogfmt(record)
+	}
+	if line.OutStdErr {
+		ch.ChStdErrOut <- s + NewLine
+	} else {
+		ch.ChStdOutOut <- s + NewLine
+	}
+}
+
+// timeoutLineMatch evaluates --timeout and --or-timeout conditions for an incoming line, matched is the result of
+// pattern matching. The timeout itself is an event that can fire only once: either by the first line arriving
+// after the deadline, or by the deadline timer.
+func timeoutLineMatch(cmd *opts.Command, matched bool, now time.Time) bool {
+	expired := !now.Before(cmd.Deadline())
+	if cmd.Conditions.AndTimeout != nil {
+		if matched && expired {
+			cmd.TimedOut = true
+			return true
 		}
+		return false
+	}
+	// --or-timeout
+	if matched {
+		if expired {
+			cmd.TimedOut = true
+		}
+		return true
+	}
+	if expired && !cmd.TimedOut {
+		cmd.TimedOut = true
+		return true
+	}
+	return false
+}
 
-		for _, n := range a.Disable {
-			i, ok := cmdIndices[n]
-			if !ok {
-				log.Fatal(fmt.Errorf("inernal error: --disable references to non-existent command %v", n))
+// timeoutEventMatch evaluates --timeout and --or-timeout conditions between lines, using the last match state of the
+// command.
+func timeoutEventMatch(cmd *opts.Command, now time.Time) bool {
+	if cmd.TimedOut || now.Before(cmd.Deadline()) {
+		return false
+	}
+	cmd.TimedOut = true
+	if cmd.Conditions.AndTimeout != nil {
+		return cmd.LastMatch
+	}
+	return true
+}
+
+// minMatchLineMatch evaluates --min-match-time for an incoming line, matched is the result of pattern matching. A
+// non-matching line interrupts the current match. The command fires once for each continuous match, when it has been
+// matching for at least the given duration.
+func minMatchLineMatch(cmd *opts.Command, matched bool, now time.Time) bool {
+	if !matched {
+		cmd.MatchStarted = time.Time{}
+		cmd.MatchFired = false
+		return false
+	}
+	if cmd.MatchStarted.IsZero() {
+		cmd.MatchStarted = now
+	}
+	if cmd.MatchFired || now.Sub(cmd.MatchStarted) < *cmd.Conditions.MinMatchTime {
+		return false
+	}
+	cmd.MatchFired = true
+	return true
+}
+
+// minMatchEventMatch evaluates --min-match-time between lines: it fires if the last match has started at least the
+// given duration ago, and no non-matching line has interrupted it since.
+func minMatchEventMatch(cmd *opts.Command, now time.Time) bool {
+	if cmd.MatchStarted.IsZero() || cmd.MatchFired {
+		return false
+	}
+	if now.Sub(cmd.MatchStarted) < *cmd.Conditions.MinMatchTime {
+		return false
+	}
+	cmd.MatchFired = true
+	return true
+}
+
+// rateLineMatch evaluates --rate and --rate-below for an incoming line, matched is the result of pattern matching.
+func rateLineMatch(cmd *opts.Command, matched bool, now time.Time) bool {
+	if matched {
+		cmd.RateTimes = append(cmd.RateTimes, now)
+	}
+	return rateUpdate(cmd, now)
+}
+
+// rateUpdate removes the matches that are out of the sliding window, and tells if the number of matches within the
+// window has crossed the rate: --rate fires when it reaches the rate, --rate-below fires when it drops below again.
+// Both of them fire only once for each crossing.
+func rateUpdate(cmd *opts.Command, now time.Time) bool {
+	r := cmd.Conditions.Rate
+	if r == nil {
+		r = cmd.Conditions.RateBelow
+	}
+	i := 0
+	for i < len(cmd.RateTimes) && now.Sub(cmd.RateTimes[i]) >= r.Window {
+		i++
+	}
+	cmd.RateTimes = cmd.RateTimes[i:]
+	high := len(cmd.RateTimes) >= r.Count
+	if high == cmd.RateHigh {
+		return false
+	}
+	cmd.RateHigh = high
+	if cmd.Conditions.Rate != nil {
+		return high
+	}
+	return !high
+}
+
+// replaceLine performs --replace and --replace-first, with regexp.Expand semantics for the replacement.
+func replaceLine(value string, r *opts.Replacement) string {
+	if !r.First {
+		return r.CompiledPattern.ReplaceAllString(value, r.Value)
+	}
+	loc := r.CompiledPattern.FindStringSubmatchIndex(value)
+	if loc == nil {
+		return value
+	}
+	result := []byte(value[:loc[0]])
+	result = r.CompiledPattern.ExpandString(result, r.Value, value, loc)
+	return string(result) + value[loc[1]:]
+}
+
+// sendSignal sends a signal to the target process(es) of --signal. Processes of an instance of PROGRAM that has
+// already exited are not signaled, because their pid may have been reused, but its process group may still exist.
+func sendSignal(child *Child, a *opts.CommandActions, sig syscall.Signal) {
+	pid := child.Cmd.Process.Pid
+	exited := false
+	select {
+	case <-child.Exited:
+		exited = true
+	default:
+	}
+	switch a.SignalTarget {
+	case opts.TargetProcess:
+		if exited {
+			return
+		}
+		if err := syscall.Kill(pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+			log.Fatal(err)
+		}
+	case opts.TargetGroup:
+		if !m.Group {
+			// PROGRAM shares the process group of tea (the signal comes from the signal policy, --restart or a limit)
+			if !exited {
+				if err := syscall.Kill(pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+					log.Fatal(err)
+				}
 			}
-			(*commands)[i].Disabled = true
+			return
 		}
-
-		for _, n := range a.Enable {
-			i, ok := cmdIndices[n]
-			if !ok {
-				log.Fatal(fmt.Errorf("internal error: --enable references to non-existent command %v", n))
+		// PROGRAM is the leader of its process group
+		if err := syscall.Kill(-pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+			log.Fatal(err)
+		}
+	case opts.TargetTree:
+		if exited {
+			return
+		}
+		descendants, err := proc.Descendants(pid)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := syscall.Kill(pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+			log.Fatal(err)
+		}
+		for _, p := range descendants {
+			// descendants may have exited since they were listed
+			if err := syscall.Kill(p, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+				log.Printf("--signal-tree: cannot signal process %v: %v", p, err)
 			}
-			(*commands)[i].Disabled = false
 		}
+	case opts.TargetPidFile:
+		target, err := proc.ReadPidFile(*a.SignalPidFile)
+		if err != nil {
+			log.Printf("--signal-pid-file: %v", err)
+			return
+		}
+		if err := syscall.Kill(target, sig); err != nil {
+			log.Printf("--signal-pid-file: cannot signal process %v: %v", target, err)
+		}
+	}
+}
 
-		for _, n := range a.Toggle {
-			i, ok := cmdIndices[n]
+// escalate sends the next signal of the kill ladder to the same target, if PROGRAM does not exit within the
+// --signal-kill-after (or --kill-after) duration after a signal action. Signals that are not in the ladder are not
+// escalated, and only one escalation can be in progress at a time.
+func escalate(child *Child, a *opts.CommandActions, sig syscall.Signal) {
+	delay := m.Opts.KillAfter
+	if a.SignalKillAfter != nil {
+		delay = a.SignalKillAfter
+	}
+	if delay == nil || a.SignalTarget == opts.TargetPidFile {
+		return
+	}
+	if _, ok := m.Opts.NextKillSignal(sig); !ok {
+		return
+	}
+	if !m.Escalating.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer m.Escalating.Store(false)
+		for {
+			next, ok := m.Opts.NextKillSignal(sig)
 			if !ok {
-				log.Fatal(fmt.Errorf("inernal error: --toggle references to non-existent command %v", n))
+				return
 			}
-			(*commands)[i].Disabled = !(*commands)[i].Disabled
+			select {
+			case <-child.Exited:
+				return
+			case <-time.After(*delay):
+			}
+			sendSignal(child, a, next)
+			child.Escalated.Store(int32(next))
+			sig = next
 		}
+	}()
+}
 
-		if a.NextLine {
-			break
+// runHook runs the --exec command of a command with sh -c. Information about the current line is passed in environment
+// variables. --exec-sync waits for the command to finish, --exec runs it in the background, but tea waits for it before
+// exiting. The output of the command is written through the output channels of the chain, see writeHookOutput.
+func (ch *Chain) runHook(a *opts.CommandActions, vars *templateVars) {
+	hook := exec.Command("sh", "-c", *a.Exec)
+	hook.Env = append(os.Environ(), vars.environ()...)
+	stdout, err := hook.StdoutPipe()
+	if err != nil {
+		log.Printf("--exec: %v", err)
+		return
+	}
+	stderr, err := hook.StderrPipe()
+	if err != nil {
+		log.Printf("--exec: %v", err)
+		return
+	}
+	if err := hook.Start(); err != nil {
+		log.Printf("--exec: %v", err)
+		return
+	}
+	m.Hooks.Add(1)
+	wgRead := sync.WaitGroup{}
+	wgRead.Add(2)
+	go writeHookOutput(stdout, ch.ChStdOutOut, &wgRead)
+	go writeHookOutput(stderr, ch.ChStdErrOut, &wgRead)
+	wait := func() {
+		defer m.Hooks.Done()
+		// the pipes must be read until EOF before Wait closes them
+		wgRead.Wait()
+		err := hook.Wait()
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			log.Printf("--exec: %v", err)
+			return
+		}
+		if a.ExecExitCode {
+			m.FixedExitCode.Store(int32(exitCode(hook.ProcessState)))
 		}
+	}
+	if a.ExecSync {
+		wait()
+	} else {
+		go wait()
+	}
+}
 
-		if a.SkipTo != nil {
-			i, ok := cmdIndices[*a.SkipTo]
-			if !ok {
-				log.Fatal(fmt.Errorf("inernal error: --skip-to references to non-existent command %v", a.SkipTo))
-			}
-			cmdIdx = i
-			continue
+// writeHookOutput writes the output of an --exec command to ch. Complete lines are written at once, so they are not
+// mixed with the lines of PROGRAM. Lines are stamped like the lines of PROGRAM when --timestamp is given.
+func writeHookOutput(reader io.Reader, ch chan string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	lineReader := lines.CreateReader(reader, m.Opts.LineBufferSize, false, 0)
+	started := m.Child.Load().Started
+	var previous time.Time
+	continued := false
+	for {
+		value, terminator, err := lineReader.Read()
+		if err != nil && !errors.Is(err, lines.ErrTooLong) {
+			return
 		}
+		if err == nil && terminator == "" {
+			// the last line of the output is not terminated, but the next line of PROGRAM must start in a new line
+			terminator = NewLine
+		}
+		if m.Opts.Timestamp != "" && m.Opts.OutputFormat == "text" && !continued {
+			now := time.Now()
+			value = stamp(now, started, previous) + " " + value
+			previous = now
+		}
+		// the rest of a line that is too long is written after it
+		continued = terminator == ""
+		ch <- value + terminator
+	}
+}
 
+// exitCode returns the exit code of a process. For processes killed by a signal, it returns 128 + the signal number,
+// like shells do.
+func exitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
 	}
+	return state.ExitCode()
+}
 
-	if closeStdIn {
-		if err := m.StdIn.Close(); err != nil {
-			log.Fatal(err)
-		}
+// templateVars provides the values of template variables for the actions of a command. The line is nil when the
+// command was triggered by a time based event.
+type templateVars struct {
+	chain  *Chain
+	cmd    *opts.Command
+	line   *Line
+	groups []string // submatches of the first matching pattern
+	names  map[string]string
+}
+
+func (v *templateVars) expand(t *expand.Template) string {
+	if t.IsConst() {
+		return t.Literal()
 	}
+	return t.Expand(v.lookup)
+}
 
-	var format = func(fmt string, a ...interface{}) string {
-		return fmt
+func (v *templateVars) expandP(t *expand.Template) *string {
+	s := v.expand(t)
+	return &s
+}
+
+// environ returns the variables as environment variables for --exec. Groups of the patterns are passed as
+// TEA_GROUP_N and TEA_GROUP_NAME.
+func (v *templateVars) environ() []string {
+	env := []string{
+		"TEA_COMMAND=" + v.cmd.Name,
+		"TEA_PID=" + strconv.Itoa(m.Child.Load().Cmd.Process.Pid),
+		"TEA_TIME=" + v.lookup("time"),
+		"TEA_COUNT=" + v.lookup("count"),
+		"TEA_STATE=" + v.lookup("state"),
 	}
-	if clr != nil {
-		format = clr.SprintfFunc()
+	env = append(env, m.Vars.Environ("TEA_VAR_")...)
+	if v.line == nil {
+		return env
+	}
+	env = append(env, "TEA_LINE="+v.lookup("line"), "TEA_LINENO="+v.lookup("lineno"), "TEA_STREAM="+v.lookup("stream"))
+	v.matchGroups()
+	for i, group := range v.groups {
+		env = append(env, fmt.Sprintf("TEA_GROUP_%d=%s", i, group))
 	}
+	for name, group := range v.names {
+		env = append(env, fmt.Sprintf("TEA_GROUP_%s=%s", name, group))
+	}
+	return env
+}
 
-	if line.OutStdErr {
-		if line.MarkStdErr != nil {
-			chStdErrOut <- format(*line.MarkStdErr)
-		} else {
-			if line.Prefix != nil {
-				chStdErrOut <- format(*line.Prefix)
-			}
-			chStdErrOut <- line.Value
-			if line.Suffix != nil {
-				chStdErrOut <- format(*line.Suffix)
+func (v *templateVars) lookup(name string) string {
+	if v.line != nil {
+		v.matchGroups()
+		if n, err := strconv.Atoi(name); err == nil {
+			if n < len(v.groups) {
+				return v.groups[n]
 			}
+			return ""
 		}
-	} else {
-		if line.MarkStdOut != nil {
-			chStdOutOut <- format(*line.MarkStdOut)
-		} else {
-			if line.Prefix != nil {
-				chStdOutOut <- format(*line.Prefix)
-			}
-			chStdOutOut <- format(line.Value)
-			if line.Suffix != nil {
-				chStdOutOut <- format(*line.Suffix)
-			}
+		if value, ok := v.names[name]; ok {
+			return value
+		}
+	}
+	switch name {
+	case "line":
+		return v.line.Value
+	case "lineno":
+		return strconv.Itoa(v.line.Number)
+	case "stream":
+		return streamName(v.line.InStdErr)
+	case "time":
+		if v.line != nil {
+			return v.line.Time.Format(TimeFormat)
 		}
+		return time.Now().Format(TimeFormat)
+	case "command":
+		return v.cmd.Name
+	case "count":
+		return strconv.Itoa(v.cmd.Count)
+	case "state":
+		return *m.State.Load()
+	case "timestamp":
+		return v.line.Stamp
+	}
+	if ref, ok := strings.CutPrefix(name, "count:"); ok {
+		return strconv.Itoa(v.chain.Commands[v.chain.CmdIdx[ref]].Count)
+	}
+	if key, ok := strings.CutPrefix(name, "field:"); ok {
+		return v.line.Fields(v.cmd.Conditions.FieldFormat)[key]
+	}
+	if ref, ok := strings.CutPrefix(name, "var:"); ok {
+		value, _ := m.Vars.Get(ref)
+		return value
+	}
+	return ""
+}
 
+// matchGroups collects the submatches of the command's patterns for the current line. Numbered groups are taken from
+// the first matching pattern, named groups from the first matching pattern that has a group with the given name.
+func (v *templateVars) matchGroups() {
+	if v.names != nil {
+		return
+	}
+	v.names = make(map[string]string)
+	for _, pat := range v.cmd.Conditions.CompiledPatterns {
+		groups := pat.FindStringSubmatch(v.line.Value)
+		if groups == nil {
+			continue
+		}
+		if v.groups == nil {
+			v.groups = groups
+		}
+		for i, name := range pat.SubexpNames() {
+			if _, exists := v.names[name]; name != "" && !exists {
+				v.names[name] = groups[i]
+			}
+		}
 	}
 }
 
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nagylzs/tea/internal/opts"
+)
+
+func TestSplitLines(t *testing.T) {
+	os.Args = []string{"tea", "--line-buffer-size", "1024", "--long-lines", "split",
+		"-c", "--set-prefix", "> ", "--set-suffix", "|\n", "--", "true"}
+	o, err := opts.ParseArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = CreateMain(o)
+	m.Child.Store(&Child{Started: time.Now()})
+
+	long := strings.Repeat("x", 2500)
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"short lines", "a\r\nb\n", "> a|\n> b|\n"},
+		{"split line", long + "\nb\n", "> " + long + "|\n> b|\n"},
+		{"split line at the end", long, "> " + long + "|\n"},
+		{"unterminated final line", "a\nb", "> a|\n> b|\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chIn := make(LineChannel, 16)
+			ReadLines(io.NopCloser(strings.NewReader(tt.input)), o.LineBufferSize, false, chIn)
+			close(chIn)
+			chOut := make(chan string, 64)
+			chain := &Chain{
+				Commands:    opts.CopyCommands(o.Commands),
+				CmdIdx:      o.CmdIdx,
+				StdOut:      true,
+				StdErr:      true,
+				ChStdOutOut: chOut,
+				ChStdErrOut: chOut,
+				ChSignal:    make(chan syscall.Signal, 8),
+			}
+			for line := range chIn {
+				chain.processLine(line)
+			}
+			close(chOut)
+			var got strings.Builder
+			for s := range chOut {
+				got.WriteString(s)
+			}
+			if got.String() != tt.want {
+				t.Errorf("got %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
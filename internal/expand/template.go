@@ -0,0 +1,98 @@
+package expand
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Template is a string that may reference variables with ${NAME}. A literal dollar sign can be written as $$. A dollar
+// sign that is not followed by { or $ is kept as it is.
+type Template struct {
+	Raw     string
+	parts   []part
+	isConst bool
+	literal string // the value of a constant template, with $$ unescaped
+}
+
+// part is either a literal string or a variable reference
+type part struct {
+	literal string
+	name    string
+	isVar   bool
+}
+
+func Parse(raw string) (*Template, error) {
+	t := &Template{Raw: raw, parts: make([]part, 0)}
+	var literal strings.Builder
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c != '$' || i+1 >= len(raw) {
+			literal.WriteByte(c)
+			continue
+		}
+		switch raw[i+1] {
+		case '$':
+			literal.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(raw[i+2:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated variable reference in %q", raw)
+			}
+			name := raw[i+2 : i+2+end]
+			if name == "" {
+				return nil, fmt.Errorf("empty variable reference in %q", raw)
+			}
+			if literal.Len() > 0 {
+				t.parts = append(t.parts, part{literal: literal.String()})
+				literal.Reset()
+			}
+			t.parts = append(t.parts, part{name: name, isVar: true})
+			i += 2 + end
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	if literal.Len() > 0 {
+		t.parts = append(t.parts, part{literal: literal.String()})
+	}
+	t.isConst = len(t.Vars()) == 0
+	if t.isConst {
+		t.literal = literal.String()
+	}
+	return t, nil
+}
+
+// Vars returns the names of the variables referenced by the template.
+func (t *Template) Vars() []string {
+	result := make([]string, 0)
+	for _, p := range t.parts {
+		if p.isVar {
+			result = append(result, p.name)
+		}
+	}
+	return result
+}
+
+// IsConst tells if the template does not reference any variables.
+func (t *Template) IsConst() bool {
+	return t.isConst
+}
+
+// Literal returns the value of a constant template. Unlike Raw, escaped dollar signs are unescaped.
+func (t *Template) Literal() string {
+	return t.literal
+}
+
+// Expand replaces variable references with the values returned by lookup.
+func (t *Template) Expand(lookup func(name string) string) string {
+	var sb strings.Builder
+	for _, p := range t.parts {
+		if p.isVar {
+			sb.WriteString(lookup(p.name))
+		} else {
+			sb.WriteString(p.literal)
+		}
+	}
+	return sb.String()
+}
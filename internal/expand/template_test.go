@@ -0,0 +1,67 @@
+package expand
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	lookup := func(name string) string {
+		return "<" + strings.ToLower(name) + ">"
+	}
+	tests := []struct {
+		name string
+		raw  string
+		want string
+		vars []string
+	}{
+		{"constant", "hello", "hello", []string{}},
+		{"variable", "a ${X} b", "a <x> b", []string{"X"}},
+		{"adjacent variables", "${A}${B}", "<a><b>", []string{"A", "B"}},
+		{"escaped dollar", "$${X} costs $$5", "${X} costs $5", []string{}},
+		{"escaped dollar with variable", "costs $$5 ${X}", "costs $5 <x>", []string{"X"}},
+		{"lone dollar", "$5 and $X", "$5 and $X", []string{}},
+		{"trailing dollar", "a$", "a$", []string{}},
+		{"empty", "", "", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse(tt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tmpl.Expand(lookup); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if got := tmpl.Vars(); !slices.Equal(got, tt.vars) {
+				t.Errorf("got vars %q, want %q", got, tt.vars)
+			}
+			if got := tmpl.IsConst(); got != (len(tt.vars) == 0) {
+				t.Errorf("got IsConst %v", got)
+			}
+			if got := tmpl.Literal(); tmpl.IsConst() && got != tt.want {
+				t.Errorf("got literal %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"unterminated", "a ${X", "unterminated variable reference"},
+		{"empty reference", "a ${}", "empty variable reference"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.raw)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
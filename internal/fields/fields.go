@@ -0,0 +1,142 @@
+package fields
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Format is the format of structured log lines
+type Format int
+
+const (
+	Auto   Format = iota // JSON if the line starts with {, logfmt otherwise
+	JSON                 // a JSON object, nested objects are flattened with dotted keys
+	Logfmt               // key=value pairs separated by spaces, values can be quoted
+)
+
+// Fields are the fields of a structured log line. All values are converted to strings.
+type Fields map[string]string
+
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "auto":
+		return Auto, nil
+	case "json":
+		return JSON, nil
+	case "logfmt":
+		return Logfmt, nil
+	}
+	return Auto, fmt.Errorf("invalid format %q, it must be auto, json or logfmt", s)
+}
+
+// Parse parses a structured log line. It returns nil if the line is not in the given format.
+func Parse(value string, format Format) Fields {
+	if format == Auto {
+		format = Logfmt
+		if strings.HasPrefix(strings.TrimSpace(value), "{") {
+			format = JSON
+		}
+	}
+	if format == JSON {
+		return parseJSON(value)
+	}
+	return parseLogfmt(value)
+}
+
+// parseJSON parses a JSON object. Nested objects are flattened, e.g. {"http":{"status":200}} has an "http.status"
+// field. Strings are unquoted, null is an empty string, arrays are kept as compact JSON.
+func parseJSON(value string) Fields {
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+	var object map[string]any
+	if err := dec.Decode(&object); err != nil || object == nil {
+		return nil
+	}
+	result := make(Fields)
+	flatten(result, "", object)
+	return result
+}
+
+func flatten(result Fields, prefix string, object map[string]any) {
+	for key, value := range object {
+		switch tv := value.(type) {
+		case map[string]any:
+			flatten(result, prefix+key+".", tv)
+		case string:
+			result[prefix+key] = tv
+		case json.Number:
+			result[prefix+key] = tv.String()
+		case bool:
+			result[prefix+key] = strconv.FormatBool(tv)
+		case nil:
+			result[prefix+key] = ""
+		default:
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(tv); err == nil {
+				result[prefix+key] = strings.TrimSuffix(buf.String(), "\n")
+			}
+		}
+	}
+}
+
+// parseLogfmt parses key=value pairs. Values can be quoted with double quotes, and a key without a value is "true".
+// The line must contain at least one key=value pair.
+func parseLogfmt(value string) Fields {
+	result := make(Fields)
+	pairs := 0
+	i := 0
+	for i < len(value) {
+		for i < len(value) && (value[i] == ' ' || value[i] == '\t') {
+			i++
+		}
+		start := i
+		for i < len(value) && value[i] != '=' && value[i] != ' ' && value[i] != '\t' {
+			i++
+		}
+		key := value[start:i]
+		if i >= len(value) || value[i] != '=' {
+			if key != "" {
+				result[key] = "true"
+			}
+			continue
+		}
+		i++ // skip =
+		if key == "" {
+			return nil
+		}
+		if i < len(value) && value[i] == '"' {
+			end := i + 1
+			for end < len(value) && value[end] != '"' {
+				if value[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(value) {
+				return nil
+			}
+			unquoted, err := strconv.Unquote(value[i : end+1])
+			if err != nil {
+				return nil
+			}
+			result[key] = unquoted
+			i = end + 1
+		} else {
+			start = i
+			for i < len(value) && value[i] != ' ' && value[i] != '\t' {
+				i++
+			}
+			result[key] = value[start:i]
+		}
+		pairs++
+	}
+	if pairs == 0 {
+		return nil
+	}
+	return result
+}
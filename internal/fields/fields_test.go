@@ -0,0 +1,40 @@
+package fields
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		format Format
+		want   Fields // nil if the line is not in the format
+	}{
+		{"json", `{"level":"info","status":200,"ok":true}`, JSON,
+			Fields{"level": "info", "status": "200", "ok": "true"}},
+		{"json nested", `{"http":{"status":404,"path":"/"}}`, JSON, Fields{"http.status": "404", "http.path": "/"}},
+		{"json null and array", `{"user":null,"tags":["a","<b>"]}`, JSON, Fields{"user": "", "tags": `["a","<b>"]`}},
+		{"json big number", `{"id":12345678901234567890}`, JSON, Fields{"id": "12345678901234567890"}},
+		{"json not an object", `["a"]`, JSON, nil},
+		{"json invalid", `{"a":`, JSON, nil},
+		{"logfmt", `level=info msg="hello world" n=3`, Logfmt, Fields{"level": "info", "msg": "hello world", "n": "3"}},
+		{"logfmt escaped quote", `msg="say \"hi\""`, Logfmt, Fields{"msg": `say "hi"`}},
+		{"logfmt empty value", `a= b=""`, Logfmt, Fields{"a": "", "b": ""}},
+		{"logfmt key without value", `debug level=warn`, Logfmt, Fields{"debug": "true", "level": "warn"}},
+		{"logfmt plain text", `hello world`, Logfmt, nil},
+		{"logfmt unterminated quote", `msg="hello`, Logfmt, nil},
+		{"logfmt empty key", `=x`, Logfmt, nil},
+		{"auto json", ` {"a":"b"}`, Auto, Fields{"a": "b"}},
+		{"auto logfmt", `a=b`, Auto, Fields{"a": "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Parse(tt.value, tt.format)
+			if (got == nil) != (tt.want == nil) || !maps.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
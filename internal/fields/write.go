@@ -0,0 +1,70 @@
+package fields
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Field is a key and a value of a record. Records are written as a list of fields, so that the order of the keys is
+// kept. Values can be strings, ints or string slices.
+type Field struct {
+	Key   string
+	Value any
+}
+
+// WriteJSON writes a record as a single line JSON object.
+func WriteJSON(record []Field) string {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, f := range record {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(encodeJSON(f.Key))
+		sb.WriteByte(':')
+		sb.WriteString(encodeJSON(f.Value))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// encodeJSON encodes a value without escaping HTML characters.
+func encodeJSON(v any) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		// only strings, ints and string slices are written, this should not happen
+		return strconv.Quote(fmt.Sprint(v))
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// WriteLogfmt writes a record as key=value pairs. Values are quoted when needed, string slices are joined with commas.
+func WriteLogfmt(record []Field) string {
+	var sb strings.Builder
+	for i, f := range record {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		var value string
+		switch tv := f.Value.(type) {
+		case string:
+			value = tv
+		case []string:
+			value = strings.Join(tv, ",")
+		default:
+			value = fmt.Sprint(tv)
+		}
+		sb.WriteString(f.Key)
+		sb.WriteByte('=')
+		if value == "" || strings.ContainsAny(value, " \t\"=\\") || strconv.Quote(value) != `"`+value+`"` {
+			value = strconv.Quote(value)
+		}
+		sb.WriteString(value)
+	}
+	return sb.String()
+}
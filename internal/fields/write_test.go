@@ -0,0 +1,30 @@
+package fields
+
+import "testing"
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		name       string
+		record     []Field
+		wantJSON   string
+		wantLogfmt string
+	}{
+		{"order is kept", []Field{{"z", "1"}, {"a", 2}}, `{"z":"1","a":2}`, `z=1 a=2`},
+		{"quoting", []Field{{"msg", `a "b" <c>`}}, `{"msg":"a \"b\" <c>"}`, `msg="a \"b\" <c>"`},
+		{"empty value", []Field{{"msg", ""}}, `{"msg":""}`, `msg=""`},
+		{"equal sign", []Field{{"expr", "a=b"}}, `{"expr":"a=b"}`, `expr="a=b"`},
+		{"control character", []Field{{"msg", "a\tb\x01"}}, `{"msg":"a\tb\u0001"}`, `msg="a\tb\x01"`},
+		{"string slice", []Field{{"tags", []string{"x", "y"}}}, `{"tags":["x","y"]}`, `tags=x,y`},
+		{"empty record", nil, `{}`, ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := WriteJSON(tt.record); got != tt.wantJSON {
+				t.Errorf("got JSON %s, want %s", got, tt.wantJSON)
+			}
+			if got := WriteLogfmt(tt.record); got != tt.wantLogfmt {
+				t.Errorf("got logfmt %s, want %s", got, tt.wantLogfmt)
+			}
+		})
+	}
+}
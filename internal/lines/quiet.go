@@ -0,0 +1,64 @@
+package lines
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// errQuiet is returned by quietReader when no data has arrived within the quiet period
+var errQuiet = errors.New("no data within the quiet period")
+
+// quietReader reads the underlying reader in a goroutine, so that reading can time out. It is used to return a partial
+// line (e.g. a prompt without a newline) when PROGRAM writes nothing else for a while.
+type quietReader struct {
+	chunks  chan []byte
+	err     error // the error of the underlying reader, valid after chunks is closed
+	pending []byte
+	quiet   time.Duration
+	wait    bool // time out when no data arrives within quiet, see Reader.Read
+}
+
+func createQuietReader(reader io.Reader, bufSize int, quiet time.Duration) *quietReader {
+	q := &quietReader{chunks: make(chan []byte), quiet: quiet}
+	go func() {
+		for {
+			buf := make([]byte, bufSize)
+			n, err := reader.Read(buf)
+			if n > 0 {
+				q.chunks <- buf[:n]
+			}
+			if err != nil {
+				q.err = err
+				close(q.chunks)
+				return
+			}
+		}
+	}()
+	return q
+}
+
+func (q *quietReader) Read(p []byte) (int, error) {
+	if len(q.pending) == 0 {
+		var chunk []byte
+		var ok bool
+		if q.wait {
+			timer := time.NewTimer(q.quiet)
+			select {
+			case chunk, ok = <-q.chunks:
+				timer.Stop()
+			case <-timer.C:
+				return 0, errQuiet
+			}
+		} else {
+			chunk, ok = <-q.chunks
+		}
+		if !ok {
+			return 0, q.err
+		}
+		q.pending = chunk
+	}
+	n := copy(p, q.pending)
+	q.pending = q.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,122 @@
+package lines
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrTooLong is returned when a line is longer than the maximum size of the Reader.
+var ErrTooLong = errors.New("line too long")
+
+// ErrPartial is returned with a partial line, when no data has arrived within the quiet period of the Reader.
+var ErrPartial = errors.New("partial line")
+
+// Reader reads lines from the output of PROGRAM. Unlike bufio.Scanner, it keeps the terminators of the lines, so that
+// the lines can be written out exactly as they were read, and it can continue after a line that is too long.
+type Reader struct {
+	reader  *bufio.Reader
+	maxSize int
+	cr      bool
+	quiet   *quietReader // nil if partial lines are not returned
+	buf     []byte
+}
+
+// CreateReader creates a Reader for lines of at most maxSize bytes. When cr is true, then a carriage return is also a
+// line boundary (e.g. for progress bars). When quiet is positive, then a partial line is returned when no data arrives
+// within quiet (e.g. for prompts that wait for input).
+func CreateReader(reader io.Reader, maxSize int, cr bool, quiet time.Duration) *Reader {
+	r := &Reader{maxSize: maxSize, cr: cr}
+	if quiet > 0 {
+		r.quiet = createQuietReader(reader, maxSize, quiet)
+		reader = r.quiet
+	}
+	r.reader = bufio.NewReaderSize(reader, maxSize)
+	return r
+}
+
+// waitQuiet sets whether reading should time out after the quiet period
+func (r *Reader) waitQuiet(wait bool) {
+	if r.quiet != nil {
+		r.quiet.wait = wait
+	}
+}
+
+// Read returns the next line without its terminator, and the terminator itself: "\n", "\r\n", "\r" (only when
+// carriage returns are line boundaries), or empty for a final line that is not terminated. The error is io.EOF (or the
+// error of the underlying reader) after the last line.
+//
+// When the line is longer than maxSize, then the first maxSize bytes are returned with ErrTooLong. The next Read
+// continues with the rest of the line, or the rest can be skipped with Discard. Similarly, a partial line that was
+// followed by the quiet period is returned with ErrPartial, and the next Read continues with the rest of the line.
+func (r *Reader) Read() (string, string, error) {
+	r.buf = r.buf[:0]
+	for {
+		r.waitQuiet(len(r.buf) > 0)
+		c, err := r.reader.ReadByte()
+		if errors.Is(err, errQuiet) && len(r.buf) == 0 {
+			continue
+		}
+		if errors.Is(err, errQuiet) {
+			return string(r.buf), "", ErrPartial
+		}
+		if err != nil {
+			if len(r.buf) > 0 {
+				return string(r.buf), "", nil
+			}
+			return "", "", err
+		}
+		if terminator, ok := r.terminator(c); ok {
+			if terminator == "\n" && len(r.buf) > 0 && r.buf[len(r.buf)-1] == '\r' {
+				return string(r.buf[:len(r.buf)-1]), "\r\n", nil
+			}
+			return string(r.buf), terminator, nil
+		}
+		if len(r.buf) >= r.maxSize {
+			_ = r.reader.UnreadByte()
+			return string(r.buf), "", ErrTooLong
+		}
+		r.buf = append(r.buf, c)
+	}
+}
+
+// Discard skips the rest of the current line, and returns its terminator. The terminator is empty when the end of
+// the input was reached.
+func (r *Reader) Discard() string {
+	last := byte(0)
+	r.waitQuiet(false)
+	for {
+		c, err := r.reader.ReadByte()
+		if err != nil {
+			return ""
+		}
+		if terminator, ok := r.terminator(c); ok {
+			if terminator == "\n" && last == '\r' {
+				return "\r\n"
+			}
+			return terminator
+		}
+		last = c
+	}
+}
+
+// terminator checks if c ends a line, and returns the terminator. A \r that is immediately followed by \n is read
+// together with the \n.
+func (r *Reader) terminator(c byte) (string, bool) {
+	switch {
+	case c == '\n':
+		return "\n", true
+	case c == '\r' && r.cr:
+		// Progress bars wait after a carriage return, so the line is returned without waiting for the next byte.
+		// A \r\n is only recognized when both are available; otherwise the \n is read as an empty line.
+		if r.reader.Buffered() > 0 {
+			if next, _ := r.reader.Peek(1); next[0] == '\n' {
+				_, _ = r.reader.ReadByte()
+				return "\r\n", true
+			}
+		}
+		return "\r", true
+	}
+	return "", false
+}
@@ -0,0 +1,130 @@
+package lines
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkReader returns its chunks one by one, like a pipe that is written in pieces
+type chunkReader struct {
+	chunks []string
+	delay  time.Duration // sleep before each chunk except the first one
+	n      int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.n >= len(r.chunks) {
+		return 0, io.EOF
+	}
+	if r.n > 0 {
+		time.Sleep(r.delay)
+	}
+	n := copy(p, r.chunks[r.n])
+	r.n++
+	return n, nil
+}
+
+// readAll reads all lines, and returns them as "value|terminator" strings. Lines that are too long are marked with
+// "!", and discarded when discard is true. Partial lines are marked with "?".
+func readAll(t *testing.T, r *Reader, discard bool) []string {
+	t.Helper()
+	result := make([]string, 0)
+	for {
+		value, terminator, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return result
+		}
+		if errors.Is(err, ErrTooLong) {
+			if discard {
+				terminator = r.Discard()
+			}
+			result = append(result, "!"+value+"|"+terminator)
+			continue
+		}
+		if errors.Is(err, ErrPartial) {
+			result = append(result, "?"+value+"|"+terminator)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, value+"|"+terminator)
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		cr     bool
+		want   []string
+	}{
+		{"lf", []string{"a\nb\n"}, false, []string{"a|\n", "b|\n"}},
+		{"crlf", []string{"a\r\nb\r\n"}, false, []string{"a|\r\n", "b|\r\n"}},
+		{"unterminated final line", []string{"a\nb"}, false, []string{"a|\n", "b|"}},
+		{"empty lines", []string{"\n\r\n\n"}, false, []string{"|\n", "|\r\n", "|\n"}},
+		{"cr is kept without cr lines", []string{"a\rb\n"}, false, []string{"a\rb|\n"}},
+		{"cr lines", []string{"1%\r50%\r100%\n"}, true, []string{"1%|\r", "50%|\r", "100%|\n"}},
+		{"crlf with cr lines", []string{"a\r\nb\n"}, true, []string{"a|\r\n", "b|\n"}},
+		{"crlf split across reads", []string{"a\r", "\nb\n"}, false, []string{"a|\r\n", "b|\n"}},
+		{"crlf split across reads with cr lines", []string{"a\r", "\nb\n"}, true, []string{"a|\r", "|\n", "b|\n"}},
+		{"line split across reads", []string{"ab", "c\nd", "e\n"}, false, []string{"abc|\n", "de|\n"}},
+		{"binary", []string{"\x00\xff\n"}, false, []string{"\x00\xff|\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := CreateReader(&chunkReader{chunks: tt.chunks}, 16, tt.cr, 0)
+			if got := readAll(t, r, false); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadTooLong(t *testing.T) {
+	long := strings.Repeat("x", 20)
+	tests := []struct {
+		name    string
+		input   string
+		discard bool
+		want    []string
+	}{
+		{"split", long + "\nb\n", false, []string{"!" + long[:16] + "|", long[16:] + "|\n", "b|\n"}},
+		{"discard", long + "\nb\n", true, []string{"!" + long[:16] + "|\n", "b|\n"}},
+		{"discard crlf", long + "\r\nb\n", true, []string{"!" + long[:16] + "|\r\n", "b|\n"}},
+		{"discard at eof", long, true, []string{"!" + long[:16] + "|"}},
+		{"exact size", long[:16] + "\n", false, []string{long[:16] + "|\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := CreateReader(strings.NewReader(tt.input), 16, false, 0)
+			if got := readAll(t, r, tt.discard); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadQuiet(t *testing.T) {
+	tests := []struct {
+		name  string
+		quiet time.Duration
+		want  []string
+	}{
+		{"partial line is returned", 20 * time.Millisecond, []string{"?name? |", "bob|\n"}},
+		{"disabled", 0, []string{"name? bob|\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := &chunkReader{chunks: []string{"name? ", "bob\n"}, delay: 200 * time.Millisecond}
+			r := CreateReader(input, 16, false, tt.quiet)
+			if got := readAll(t, r, false); !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
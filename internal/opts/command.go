@@ -6,27 +6,122 @@ import (
 	"time"
 
 	"github.com/fatih/color"
+	"github.com/nagylzs/tea/internal/expand"
+	"github.com/nagylzs/tea/internal/fields"
+)
+
+// Replacement rewrites the current line, see --replace and --replace-first
+type Replacement struct {
+	RawPattern      string
+	CompiledPattern *regexp.Regexp
+	Value           string
+	First           bool // replace the first match only
+}
+
+// SignalTarget tells which processes receive the signal of --signal
+type SignalTarget int
+
+const (
+	TargetProcess SignalTarget = iota // PROGRAM only
+	TargetGroup                       // the process group of PROGRAM
+	TargetTree                        // PROGRAM and all of its descendants
+	TargetPidFile                     // the process given in a pid file
 )
 
 type CommandActions struct {
-	MarkStdOut    *string
-	MarkStdErr    *string
-	SetPrefix     *string
-	SetSuffix     *string
-	NextLine      bool
-	SkipTo        *string
-	Disable       []string
-	Enable        []string
-	Toggle        []string
-	Signal        *syscall.Signal
-	Input         *string
-	InputFile     *string
-	CloseStdIn    bool
-	SetExitCode   *int32
-	ClearExitCode bool
-	SendToStdOut  bool
-	SendToStdErr  bool
-	Color         *color.Color
+	Replace         []Replacement
+	MarkStdOut      *string
+	MarkStdErr      *string
+	SetPrefix       *string
+	SetSuffix       *string
+	NextLine        bool
+	SkipTo          *string
+	Disable         []string
+	Enable          []string
+	Toggle          []string
+	ResetCount      []string
+	SetVar          []VarAssignment
+	IncrVar         []string
+	UnsetVar        []string
+	GotoState       *string
+	Signal          *syscall.Signal
+	SignalTarget    SignalTarget
+	SignalPidFile   *string
+	SignalKillAfter *time.Duration
+	Restart         bool // restart PROGRAM, see --restart
+	Input           *string
+	Exec            *string
+	ExecSync        bool // wait for Exec to finish before processing continues
+	ExecExitCode    bool // use the exit code of Exec as the exit code of tea
+	InputFile       *string
+	CloseStdIn      bool
+	SetExitCode     *int32
+	ClearExitCode   bool
+	SendToStdOut    bool
+	SendToStdErr    bool
+	Drop            bool
+	Color           *color.Color
+
+	// compiled templates of string actions, they are created by validateOptions
+	CompiledMarkStdOut *expand.Template
+	CompiledMarkStdErr *expand.Template
+	CompiledSetPrefix  *expand.Template
+	CompiledSetSuffix  *expand.Template
+	CompiledInput      *expand.Template
+}
+
+// VarOp is the operator of a variable condition
+type VarOp int
+
+const (
+	VarEquals    VarOp = iota // --if VAR==VALUE
+	VarNotEquals              // --if VAR!=VALUE
+	VarSet                    // --if-set VAR
+	VarUnset                  // --if-unset VAR
+)
+
+// VarCondition tests a named variable, see --if, --if-set and --if-unset
+type VarCondition struct {
+	Name  string
+	Op    VarOp
+	Value string
+}
+
+// VarAssignment sets a named variable, see --set
+type VarAssignment struct {
+	Name          string
+	Value         string
+	CompiledValue *expand.Template
+}
+
+// FieldOp is the operator of a field condition
+type FieldOp int
+
+const (
+	FieldEquals  FieldOp = iota // --field KEY=VALUE
+	FieldMatches                // --field-match KEY=REGEX
+	FieldGreater                // --field-gt KEY=NUMBER
+	FieldLess                   // --field-lt KEY=NUMBER
+)
+
+// FieldCondition tests a field of a structured log line
+type FieldCondition struct {
+	Key     string
+	Op      FieldOp
+	Value   string
+	Pattern *regexp.Regexp // for FieldMatches
+	Number  float64        // for FieldGreater and FieldLess
+}
+
+// MatchesLines tells if the command has conditions that are evaluated on the lines (patterns or field conditions).
+func (c *CommandConditions) MatchesLines() bool {
+	return len(c.RawPatterns) > 0 || len(c.Fields) > 0
+}
+
+// Rate is the value of --rate and --rate-below: Count matches within Window.
+type Rate struct {
+	Count  int
+	Window time.Duration
 }
 
 type CommandConditions struct {
@@ -41,20 +136,105 @@ type CommandConditions struct {
 	OrTimeout          *time.Duration
 	MinMatchTime       *time.Duration
 	NoInputForDuration *time.Duration
+	OnSignal           *syscall.Signal
+	MinCount           *int // fire only from the Nth match, see --min-count
+	MaxCount           *int // fire only until the Nth match, see --max-count
+	Every              *int // fire only for every Nth match, see --every
+	Rate               *Rate
+	RateBelow          *Rate
+	Vars               []VarCondition
+	InState            []string
+	OnEnter            *string // the command is a hook that runs when the state is entered, see --on-enter
+	OnExit             *string // the command is a hook that runs when the state is left, see --on-exit
+	Fields             []FieldCondition
+	FieldFormat        fields.Format
 }
 
 type Command struct {
 	Name         string
+	Source       string // FILE:LINE when the command was loaded from a --config file
 	Disabled     bool
 	LineDisabled bool
 	LineEnabled  bool
 	Conditions   *CommandConditions
 	Actions      *CommandActions
 	Started      time.Time
+	LastMatch    bool        // result of the last pattern match, used by --timeout
+	TimedOut     bool        // the deadline of --timeout or --or-timeout has been processed
+	MatchStarted time.Time   // start of the current continuous match, zero if the last line did not match
+	MatchFired   bool        // --min-match-time has already fired for the current continuous match
+	Count        int         // number of matches, see --min-count, --max-count and --every
+	RateTimes    []time.Time // times of the matches within the window of --rate or --rate-below
+	RateHigh     bool        // the number of matches within the window has reached the rate
 }
 
+// ResetStarted restarts the time based conditions of the command.
 func (c *Command) ResetStarted() {
 	c.Started = time.Now()
+	c.LastMatch = !c.Conditions.MatchesLines()
+	c.TimedOut = false
+	c.MatchStarted = time.Time{}
+	c.MatchFired = false
+	c.RateTimes = nil
+	c.RateHigh = false
+}
+
+// HasTimeout tells if the command has a --timeout or --or-timeout condition.
+func (c *Command) HasTimeout() bool {
+	return c.Conditions.AndTimeout != nil || c.Conditions.OrTimeout != nil
+}
+
+// Deadline returns the time when the --timeout or --or-timeout of the command is reached.
+func (c *Command) Deadline() time.Time {
+	if c.Conditions.AndTimeout != nil {
+		return c.Started.Add(*c.Conditions.AndTimeout)
+	}
+	if c.Conditions.OrTimeout != nil {
+		return c.Started.Add(*c.Conditions.OrTimeout)
+	}
+	return c.Started
+}
+
+// PendingDeadline returns the time when a time based condition of the command should be evaluated between lines.
+// The second return value is false if there is no such deadline. (--no-input-for-duration is not included.)
+func (c *Command) PendingDeadline() (time.Time, bool) {
+	if c.HasTimeout() {
+		return c.Deadline(), !c.TimedOut
+	}
+	if c.Conditions.MinMatchTime != nil {
+		if c.MatchStarted.IsZero() || c.MatchFired {
+			return time.Time{}, false
+		}
+		return c.MatchStarted.Add(*c.Conditions.MinMatchTime), true
+	}
+	if r := c.Conditions.RateBelow; r != nil && c.RateHigh && len(c.RateTimes) >= r.Count {
+		// the rate drops below when the Nth latest match leaves the window
+		return c.RateTimes[len(c.RateTimes)-r.Count].Add(r.Window), true
+	}
+	return time.Time{}, false
+}
+
+// HasRate tells if the command has a --rate or --rate-below condition.
+func (c *Command) HasRate() bool {
+	return c.Conditions.Rate != nil || c.Conditions.RateBelow != nil
+}
+
+// IsEvent tells if the command is only triggered by events between lines (it does not process lines at all).
+func (c *Command) IsEvent() bool {
+	return c.Conditions.NoInputForDuration != nil || c.Conditions.OnSignal != nil || c.IsStateHook()
+}
+
+// IsStateHook tells if the command is only triggered by state transitions, see --on-enter and --on-exit.
+func (c *Command) IsStateHook() bool {
+	return c.Conditions.OnEnter != nil || c.Conditions.OnExit != nil
+}
+
+// CopyCommands creates a new instance of a command chain. Conditions and actions are shared, but the state of the
+// commands is independent.
+func CopyCommands(commands []Command) []Command {
+	result := make([]Command, len(commands))
+	copy(result, commands)
+	return result
 }
 
 func CreateCommand() Command {
@@ -62,7 +242,7 @@ func CreateCommand() Command {
 }
 
 func CreateActions() *CommandActions {
-	return &CommandActions{Disable: make([]string, 0), Enable: make([]string, 0), Toggle: make([]string, 0)}
+	return &CommandActions{Replace: make([]Replacement, 0), Disable: make([]string, 0), Enable: make([]string, 0), Toggle: make([]string, 0)}
 }
 
 func CreateConditions() *CommandConditions {
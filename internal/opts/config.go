@@ -0,0 +1,237 @@
+package opts
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// configReader walks a JSON config file token by token, so that errors can be reported with line numbers.
+type configReader struct {
+	fpath string
+	data  []byte
+	dec   *json.Decoder
+}
+
+// loadConfig adds the commands given in a JSON config file. The options of the commands are converted into
+// command line arguments, and they are parsed the same way as command line options.
+func loadConfig(fpath string) error {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return fmt.Errorf("--config: %v", err)
+	}
+	r := &configReader{fpath: fpath, data: data, dec: json.NewDecoder(bytes.NewReader(data))}
+	r.dec.UseNumber()
+
+	// the config is parsed with its own argument list, restore the command line arguments when done
+	savedArgs, savedArgIdx := args, argIdx
+	defer func() {
+		args, argIdx = savedArgs, savedArgIdx
+	}()
+
+	if err := r.expectDelim('{'); err != nil {
+		return err
+	}
+	for r.dec.More() {
+		key, line, err := r.key()
+		if err != nil {
+			return err
+		}
+		if key != "commands" {
+			return r.errorf(line, "unknown key %q", key)
+		}
+		if err := r.expectDelim('['); err != nil {
+			return err
+		}
+		for r.dec.More() {
+			if err := r.command(); err != nil {
+				return err
+			}
+		}
+		if err := r.expectDelim(']'); err != nil {
+			return err
+		}
+	}
+	if err := r.expectDelim('}'); err != nil {
+		return err
+	}
+	if _, err := r.dec.Token(); !errors.Is(err, io.EOF) {
+		return r.errorf(r.line(r.dec.InputOffset()), "unexpected data after the end of the config")
+	}
+	return nil
+}
+
+// command reads a single command object.
+func (r *configReader) command() error {
+	line := r.line(r.nextOffset())
+	if err := r.expectDelim('{'); err != nil {
+		return err
+	}
+	addEmptyCommand()
+	currentCommand().Source = fmt.Sprintf("%v:%v", r.fpath, line)
+	for r.dec.More() {
+		key, line, err := r.key()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "name":
+			var name string
+			if err := r.dec.Decode(&name); err != nil {
+				return r.errorf(line, "name must be a string")
+			}
+			if name == "" || strings.HasPrefix(name, "-") {
+				return r.errorf(line, "name cannot be empty and cannot start with '-'")
+			}
+			currentCommand().Name = name
+		case "disabled", "line-disabled", "line-enabled":
+			if err := r.option(key, line, isCommandOption); err != nil {
+				return err
+			}
+		case "conditions":
+			if err := r.section(isConditionOption); err != nil {
+				return err
+			}
+		case "actions":
+			if err := r.section(isActionOption); err != nil {
+				return err
+			}
+		default:
+			return r.errorf(line, "unknown key %q", key)
+		}
+	}
+	return r.expectDelim('}')
+}
+
+// section reads the "conditions" or "actions" object of a command.
+func (r *configReader) section(allowed func(Option) bool) error {
+	if err := r.expectDelim('{'); err != nil {
+		return err
+	}
+	for r.dec.More() {
+		key, line, err := r.key()
+		if err != nil {
+			return err
+		}
+		if err := r.option(key, line, allowed); err != nil {
+			return err
+		}
+	}
+	return r.expectDelim('}')
+}
+
+// option reads the value of an option, converts it into command line arguments, and parses them. A true value is
+// a flag without a value, a false value omits the option, and an array repeats the option for each of its elements.
+// Elements of the array can be arrays, for options that have multiple values.
+func (r *configReader) option(key string, line int, allowed func(Option) bool) error {
+	arg := "--" + key
+	opt, ok := longOptions[arg]
+	if !ok || !allowed(opt) {
+		return r.errorf(line, "invalid option %q", key)
+	}
+	var value any
+	if err := r.dec.Decode(&value); err != nil {
+		return r.errorf(line, "%v: %v", key, err)
+	}
+	values, ok := value.([]any)
+	if !ok {
+		values = []any{value}
+	}
+	for _, v := range values {
+		switch tv := v.(type) {
+		case bool:
+			if !tv {
+				continue
+			}
+			args = []string{arg}
+		case string:
+			args = []string{arg, tv}
+		case json.Number:
+			args = []string{arg, tv.String()}
+		case []any:
+			// options with multiple values, e.g. "replace": [["PATTERN", "REPLACEMENT"]]
+			args = []string{arg}
+			for _, item := range tv {
+				switch ti := item.(type) {
+				case string:
+					args = append(args, ti)
+				case json.Number:
+					args = append(args, ti.String())
+				default:
+					return r.errorf(line, "%v: values of nested arrays must be strings or numbers", key)
+				}
+			}
+		default:
+			return r.errorf(line, "%v: value must be a boolean, a string, a number or an array", key)
+		}
+		argIdx = 0
+		if err := parseOption(opt, arg); err != nil {
+			return r.errorf(line, "%v", err)
+		}
+		if argIdx+1 < len(args) {
+			return r.errorf(line, "%v does not take a value, use true or false", key)
+		}
+	}
+	return nil
+}
+
+// key reads the next object key, and returns it with its line number.
+func (r *configReader) key() (string, int, error) {
+	tok, err := r.dec.Token()
+	if err != nil {
+		return "", 0, r.wrap(err)
+	}
+	line := r.line(r.dec.InputOffset())
+	key, ok := tok.(string)
+	if !ok {
+		return "", 0, r.errorf(line, "unexpected %v", tok)
+	}
+	return key, line, nil
+}
+
+func (r *configReader) expectDelim(delim json.Delim) error {
+	tok, err := r.dec.Token()
+	if err != nil {
+		return r.wrap(err)
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return r.errorf(r.line(r.dec.InputOffset()), "expected %v, found %v", delim, tok)
+	}
+	return nil
+}
+
+// nextOffset returns the offset of the next token, skipping whitespace and separators.
+func (r *configReader) nextOffset() int64 {
+	offset := r.dec.InputOffset()
+	for offset < int64(len(r.data)) && strings.ContainsRune(" \t\r\n,:", rune(r.data[offset])) {
+		offset++
+	}
+	return offset
+}
+
+// line converts an offset to a line number.
+func (r *configReader) line(offset int64) int {
+	offset = min(offset, int64(len(r.data)))
+	return bytes.Count(r.data[:offset], []byte{'\n'}) + 1
+}
+
+func (r *configReader) wrap(err error) error {
+	var syntaxErr *json.SyntaxError
+	isSyntaxErr := errors.As(err, &syntaxErr)
+	if errors.Is(err, io.EOF) || (isSyntaxErr && syntaxErr.Offset >= int64(len(r.data))) {
+		// a truncated file is a syntax error at its end
+		return r.errorf(r.line(int64(len(r.data))), "unexpected end of file")
+	}
+	if isSyntaxErr {
+		return r.errorf(r.line(syntaxErr.Offset), "%v", err)
+	}
+	return r.errorf(r.line(r.dec.InputOffset()), "%v", err)
+}
+
+func (r *configReader) errorf(line int, format string, a ...any) error {
+	return fmt.Errorf("%v:%v: %v", r.fpath, line, fmt.Sprintf(format, a...))
+}
@@ -0,0 +1,98 @@
+package opts
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig loads a config into an empty command list. The global options are restored after the test.
+func loadTestConfig(t *testing.T, config string) ([]Command, string, error) {
+	t.Helper()
+	saved := Opts
+	t.Cleanup(func() {
+		Opts = saved
+	})
+	Opts.Commands = make([]Command, 0)
+	fpath := filepath.Join(t.TempDir(), "tea.json")
+	if err := os.WriteFile(fpath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	err := loadConfig(fpath)
+	return Opts.Commands, fpath, err
+}
+
+func TestLoadConfig(t *testing.T) {
+	config := `{
+  "commands": [
+    {
+      "name": "ready",
+      "conditions": {"pattern": ["ready", "listening"], "std-err": true},
+      "actions": {"set-exit-code": 0, "signal": "SIGINT", "replace": [["a", "b"]], "drop": false}
+    },
+    {
+      "disabled": true,
+      "conditions": {"timeout": "120s"},
+      "actions": {"set-exit-code": 1}
+    }
+  ]
+}`
+	commands, fpath, err := loadTestConfig(t, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 2 {
+		t.Fatalf("got %v commands, want 2", len(commands))
+	}
+	ready := commands[0]
+	if ready.Name != "ready" || ready.Source != fpath+":3" {
+		t.Errorf("got name %q and source %q", ready.Name, ready.Source)
+	}
+	if got := strings.Join(ready.Conditions.RawPatterns, ","); got != "ready,listening" {
+		t.Errorf("got patterns %q", got)
+	}
+	if !ready.Conditions.StdErr || ready.Actions.Drop {
+		t.Errorf("got stderr %v and drop %v", ready.Conditions.StdErr, ready.Actions.Drop)
+	}
+	if ready.Actions.SetExitCode == nil || *ready.Actions.SetExitCode != 0 || ready.Actions.Signal == nil {
+		t.Errorf("got exit code %v and signal %v", ready.Actions.SetExitCode, ready.Actions.Signal)
+	}
+	if len(ready.Actions.Replace) != 1 {
+		t.Errorf("got %v replacements, want 1", len(ready.Actions.Replace))
+	}
+	timeout := commands[1]
+	if !timeout.Disabled || timeout.Conditions.AndTimeout == nil || timeout.Source != fpath+":8" {
+		t.Errorf("got disabled %v, timeout %v and source %q", timeout.Disabled, timeout.Conditions.AndTimeout,
+			timeout.Source)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string // FILE is replaced by the path of the config
+	}{
+		{"unknown top level key", "{\n  \"cmds\": []\n}", `FILE:2: unknown key "cmds"`},
+		{"unknown command key", "{\"commands\": [\n  {\"nmae\": \"x\"}\n]}", `FILE:2: unknown key "nmae"`},
+		{"empty name", "{\"commands\": [{\"name\": \"\"}]}", "FILE:1: name cannot be empty"},
+		{"action as condition", "{\"commands\": [\n{\"conditions\":\n{\"drop\": true}}]}", `FILE:3: invalid option "drop"`},
+		{"flag with value", "{\"commands\": [{\"actions\": {\"drop\": \"yes\"}}]}", "does not take a value"},
+		{"invalid value", "{\"commands\": [{\"actions\": {\"signal\": \"SIGFOO\"}}]}", "FILE:1: "},
+		{"nested object", "{\"commands\": [{\"actions\": {\"signal\": {}}}]}", "value must be a boolean"},
+		{"syntax error", "{\"commands\": [\n\n  {,}]}", "FILE:3: invalid character"},
+		{"unexpected end", "{\"commands\": [\n", "FILE:2: unexpected end of file"},
+		{"data after the end", "{\"commands\": []}\n{}", "FILE:2: unexpected data after the end of the config"},
+		{"not an object", "[]", "FILE:1: expected {"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, fpath, err := loadTestConfig(t, tt.config)
+			want := strings.ReplaceAll(tt.want, "FILE", fpath)
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("got error %v, want %q", err, want)
+			}
+		})
+	}
+}
@@ -5,8 +5,14 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/fatih/color"
+	"github.com/nagylzs/tea/internal/fields"
 )
 
 type Type struct {
@@ -16,18 +22,52 @@ type Type struct {
 	PidFile        string
 	LineBufferSize int
 	NoStdBuf       bool
+	Pty            bool
 	ShareCommands  bool
 	ShareStreams   bool
+	SignalPolicy   map[syscall.Signal]syscall.Signal // see --signal-policy, 0 means ignore
+	KillAfter      *time.Duration
+	KillLadder     []syscall.Signal
+	MaxRuntime     *time.Duration
+	MaxIdle        *time.Duration
+	MaxSignal      syscall.Signal
+	RestartOnExit  bool
+	RestartCodes   []int // exit codes that trigger --restart-on-exit, empty means any non-zero exit code
+	RestartMax     int   // maximum number of restarts, -1 means unlimited
+	RestartBackoff time.Duration
+	RestartMaxWait time.Duration
+	RestartReset   bool
+	RestartSignal  syscall.Signal
+	InitialState   string
+	StateFile      string
+	States         map[string]bool // names of the states, see --initial-state and --goto-state
+	RecordStart    *regexp.Regexp
+	RecordContinue *regexp.Regexp
+	RecordTimeout  time.Duration
+	PromptTimeout  time.Duration // negative: the default of --prompt-timeout, see Validate
+	OutputFormat   string        // text, json or logfmt
+	CRLines        bool          // a carriage return is also a line boundary
+	LongLines      string        // split, truncate or fail, see --line-buffer-size
+	Timestamp      string        // wall, elapsed or delta, empty if lines are not stamped
+	TimestampFmt   string        // Go layout for wall clock timestamps
 	Commands       []Command
 	CmdIdx         map[string]int
 	Program        string
 	ProgramArgs    []string
 }
 
-var Opts = Type{ListSignals: false, Help: false, ShowVersion: false, LineBufferSize: 65535, Commands: make([]Command, 0)}
+var Opts = Type{ListSignals: false, Help: false, ShowVersion: false, LineBufferSize: 65535, Commands: make([]Command, 0), SignalPolicy: make(map[syscall.Signal]syscall.Signal),
+	KillLadder: []syscall.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL}, MaxSignal: syscall.SIGTERM,
+	RestartMax: -1, RestartBackoff: time.Second, RestartMaxWait: time.Minute, RestartSignal: syscall.SIGTERM,
+	RecordTimeout: 200 * time.Millisecond, PromptTimeout: -1, OutputFormat: "text",
+	TimestampFmt: "15:04:05.000", LongLines: "fail"}
 
-var argIdx = 0  // arg index
-var cmdIdx = -1 // block index
+var args = os.Args // arguments being parsed
+var argIdx = 0     // arg index
+var cmdIdx = -1    // block index
+
+// inlineValue is the value of an option given in the --option=VALUE form, only options with optional values accept it
+var inlineValue *string
 
 type Option int
 
@@ -38,8 +78,33 @@ const (
 	PID
 	LineBufferSize
 	NoStdBuf
+	Pty
+	Config
 	ShareCommands
 	ShareStreams
+	SignalPolicy
+	KillAfter
+	KillLadder
+	MaxRuntime
+	MaxIdle
+	MaxSignal
+	RestartOnExit
+	RestartMax
+	RestartBackoff
+	RestartMaxWait
+	RestartReset
+	RestartSignal
+	InitialState
+	StateFile
+	RecordStart
+	RecordContinue
+	RecordTimeout
+	PromptTimeout
+	OutputFormat
+	Timestamp
+	TimestampFormat
+	CRLines
+	LongLines
 	NewCommand
 	Disabled
 	LineDisabled
@@ -53,6 +118,25 @@ const (
 	OrTimeout
 	MinMatchTime
 	NoInputForDuration
+	OnSignal
+	MinCount
+	MaxCount
+	Every
+	RateAbove
+	RateBelow
+	If
+	IfSet
+	IfUnset
+	InState
+	OnEnter
+	OnExit
+	Field
+	FieldMatch
+	FieldGt
+	FieldLt
+	FieldFormat
+	Replace
+	ReplaceFirst
 	MarkStdout
 	MarkStdErr
 	SetPrefix
@@ -67,15 +151,29 @@ const (
 	BlinkRapid
 	SendToStdOut
 	SendToStdErr
+	Drop
 	Next
 	SkipTo
 	Disable
 	Enable
 	Toggle
+	ResetCount
+	SetVar
+	IncrVar
+	UnsetVar
+	GotoState
 	Signal
+	SignalGroup
+	SignalTree
+	SignalPidFile
+	SignalKillAfter
+	Restart
 	SendInput
 	SendInputFile
 	CloseStdin
+	Exec
+	ExecSync
+	ExecExitCode
 	SetExitCode
 	ClearExitCode
 )
@@ -102,8 +200,33 @@ var longOptions = map[string]Option{
 	"--pid":                   PID,
 	"--line-buffer-size":      LineBufferSize,
 	"--no-stdbuf":             NoStdBuf,
+	"--pty":                   Pty,
+	"--config":                Config,
 	"--share-commands":        ShareCommands,
 	"--share-streams":         ShareStreams,
+	"--signal-policy":         SignalPolicy,
+	"--kill-after":            KillAfter,
+	"--kill-ladder":           KillLadder,
+	"--max-runtime":           MaxRuntime,
+	"--max-idle":              MaxIdle,
+	"--max-signal":            MaxSignal,
+	"--restart-on-exit":       RestartOnExit,
+	"--restart-max":           RestartMax,
+	"--restart-backoff":       RestartBackoff,
+	"--restart-max-wait":      RestartMaxWait,
+	"--restart-reset":         RestartReset,
+	"--restart-signal":        RestartSignal,
+	"--initial-state":         InitialState,
+	"--state-file":            StateFile,
+	"--record-start":          RecordStart,
+	"--record-continue":       RecordContinue,
+	"--record-timeout":        RecordTimeout,
+	"--prompt-timeout":        PromptTimeout,
+	"--output-format":         OutputFormat,
+	"--timestamp":             Timestamp,
+	"--timestamp-format":      TimestampFormat,
+	"--cr-lines":              CRLines,
+	"--long-lines":            LongLines,
 	"--command":               NewCommand,
 	"--disabled":              Disabled,
 	"--line-disabled":         LineDisabled,
@@ -117,6 +240,25 @@ var longOptions = map[string]Option{
 	"--or-timeout":            OrTimeout,
 	"--min-match-time":        MinMatchTime,
 	"--no-input-for-duration": NoInputForDuration,
+	"--on-signal":             OnSignal,
+	"--min-count":             MinCount,
+	"--max-count":             MaxCount,
+	"--every":                 Every,
+	"--rate":                  RateAbove,
+	"--rate-below":            RateBelow,
+	"--if":                    If,
+	"--if-set":                IfSet,
+	"--if-unset":              IfUnset,
+	"--in-state":              InState,
+	"--on-enter":              OnEnter,
+	"--on-exit":               OnExit,
+	"--field":                 Field,
+	"--field-match":           FieldMatch,
+	"--field-gt":              FieldGt,
+	"--field-lt":              FieldLt,
+	"--field-format":          FieldFormat,
+	"--replace":               Replace,
+	"--replace-first":         ReplaceFirst,
 	"--mark":                  MarkStdout,
 	"--mark-stderr":           MarkStdErr,
 	"--set-prefix":            SetPrefix,
@@ -131,34 +273,53 @@ var longOptions = map[string]Option{
 	"--blink-rapid":           BlinkRapid,
 	"--send-to-stdout":        SendToStdOut,
 	"--send-to-stderr":        SendToStdErr,
+	"--drop":                  Drop,
 	"--next-line":             Next,
 	"--skip-to":               SkipTo,
 	"--disable":               Disable,
 	"--enable":                Enable,
 	"--toggle":                Toggle,
+	"--reset-count":           ResetCount,
+	"--set":                   SetVar,
+	"--incr":                  IncrVar,
+	"--unset":                 UnsetVar,
+	"--goto-state":            GotoState,
 	"--signal":                Signal,
+	"--signal-group":          SignalGroup,
+	"--signal-tree":           SignalTree,
+	"--signal-pid-file":       SignalPidFile,
+	"--signal-kill-after":     SignalKillAfter,
+	"--restart":               Restart,
 	"--send-input":            SendInput,
 	"--send-input-file":       SendInputFile,
 	"--close":                 CloseStdin,
+	"--exec":                  Exec,
+	"--exec-sync":             ExecSync,
+	"--exec-exit-code":        ExecExitCode,
 	"--set-exit-code":         SetExitCode,
 	"--clear-exit-code":       ClearExitCode,
 }
 
 func internalParseArgs() error {
-	if len(os.Args) == 1 {
+	args = os.Args
+	if len(args) == 1 {
 		Opts.Help = true
 		return nil
 	}
 
 	argIdx = 0
 	dDash := false
-	for argIdx+1 < len(os.Args) {
+	for argIdx+1 < len(args) {
 		argIdx++
-		arg := os.Args[argIdx]
+		arg := args[argIdx]
 		if arg == "--" {
 			dDash = true
 			break
 		}
+		inlineValue = nil
+		if name, value, found := strings.Cut(arg, "="); found && strings.HasPrefix(arg, "--") {
+			arg, inlineValue = name, &value
+		}
 		opt, ok := longOptions[arg]
 		if !ok {
 			opt, ok = shortOptions[arg]
@@ -166,8 +327,6 @@ func internalParseArgs() error {
 		if !ok {
 			return fmt.Errorf("invalid command: %v", arg)
 		}
-		err2 := error(nil)
-
 		if !isGlobalOption(opt) && opt != NewCommand {
 			if cmdIdx < 0 {
 				return fmt.Errorf("%v can only be used inside a --command", arg)
@@ -183,119 +342,19 @@ func internalParseArgs() error {
 		case ListSignals:
 			Opts.ListSignals = true
 			return nil
-		case PID:
-			Opts.PidFile, err2 = popStringArg("--pid")
-		case LineBufferSize:
-			Opts.LineBufferSize, err2 = popIntArg("--line-buffer-size")
-		case NoStdBuf:
-			Opts.NoStdBuf = true
-		case ShareCommands:
-			Opts.ShareCommands = true
-		case ShareStreams:
-			Opts.ShareStreams = true
-		case NewCommand:
-			addEmptyCommand()
-			currentCommand().Name, err2 = popOptName("command")
-		case Disabled:
-			currentCommand().Disabled = true
-		case LineDisabled:
-			currentCommand().LineDisabled = true
-		case LineEnabled:
-			currentCommand().LineEnabled = true
-		case Pattern:
-			err2 = addPattern(arg)
-		case Or:
-			currentConditions().Or = true
-		case No:
-			currentConditions().No = true
-		case StdErr:
-			currentConditions().StdOut = false
-			currentConditions().StdErr = true
-		case StdAll:
-			currentConditions().StdOut = true
-			currentConditions().StdErr = true
-		case AndTimeout:
-			currentConditions().AndTimeout, err2 = popDurationArg(arg)
-		case OrTimeout:
-			currentConditions().OrTimeout, err2 = popDurationArg(arg)
-		case MinMatchTime:
-			currentConditions().MinMatchTime, err2 = popDurationArg(arg)
-		case NoInputForDuration:
-			currentConditions().NoInputForDuration, err2 = popDurationArg(arg)
-		case MarkStdout:
-			currentActions().MarkStdOut, err2 = popStringPArg(arg)
-		case MarkStdErr:
-			currentActions().MarkStdErr, err2 = popStringPArg(arg)
-		case SetPrefix:
-			currentActions().SetPrefix, err2 = popStringPArg(arg)
-		case SetSuffix:
-			currentActions().SetSuffix, err2 = popStringPArg(arg)
-		case FgColor:
-			attr, err2 := popColorFgAttrArg(arg)
-			if err2 == nil {
-				changeColorAttribute(attr)
-			}
-		case BgColor:
-			attr, err2 := popColorBgAttrArg(arg)
-			if err2 == nil {
-				changeColorAttribute(attr)
-			}
-		case Bold:
-			changeColorAttribute(color.Bold)
-		case Italic:
-			changeColorAttribute(color.Italic)
-		case Faint:
-			changeColorAttribute(color.Bold)
-		case Underline:
-			changeColorAttribute(color.Underline)
-		case BlinkSlow:
-			changeColorAttribute(color.BlinkSlow)
-		case BlinkRapid:
-			changeColorAttribute(color.BlinkRapid)
-		case SendToStdOut:
-			currentActions().SendToStdOut = true
-		case SendToStdErr:
-			currentActions().SendToStdErr = true
-		case Next:
-			currentActions().NextLine = true
-		case SkipTo:
-			currentActions().SkipTo, err2 = popNamePArg(arg)
-		case Disable:
-			err2 = appendNameArg(arg, &currentActions().Disable)
-		case Enable:
-			err2 = appendNameArg(arg, &currentActions().Enable)
-		case Toggle:
-			err2 = appendNameArg(arg, &currentActions().Toggle)
-		case Signal:
-			currentActions().Signal, err2 = popSignalPArg(arg)
-		case SendInput:
-			currentActions().Input, err2 = popStringPArg(arg)
-		case SendInputFile:
-			currentActions().InputFile, err2 = popStringPArg(arg)
-		case CloseStdin:
-			currentActions().CloseStdIn = true
-		case SetExitCode:
-			var ec int
-			ec, err2 = popIntArg("--set-exit-code")
-			if ec < 0 || ec > 255 {
-				err2 = errors.New("--set-exit-code: code must be between 0 and 255")
-			} else {
-				var iec int32
-				iec = int32(ec)
-				currentActions().SetExitCode = &iec
-			}
-		case ClearExitCode:
-			currentActions().ClearExitCode = true
 		}
-		if err2 != nil {
-			return err2
+		if err := parseOption(opt, arg); err != nil {
+			return err
+		}
+		if inlineValue != nil {
+			return fmt.Errorf("%v does not accept a value after '='", arg)
 		}
 	}
 
 	if !dDash {
 		return errors.New("you must specify -- followed by PROGRAM and ARGS")
 	}
-	tail := os.Args[argIdx+1:]
+	tail := args[argIdx+1:]
 	if len(tail) < 1 {
 		return errors.New("you must specify -- followed by PROGRAM and ARGS")
 	}
@@ -303,7 +362,8 @@ func internalParseArgs() error {
 	if err != nil {
 		return err
 	}
-	if Opts.NoStdBuf {
+	if Opts.NoStdBuf || Opts.Pty {
+		// stdout of PROGRAM is line buffered under a pseudo-terminal, stdbuf is not needed
 		Opts.Program = prg
 		if len(tail) > 1 {
 			Opts.ProgramArgs = tail[1:]
@@ -322,6 +382,306 @@ func internalParseArgs() error {
 	return validateOptions()
 }
 
+// parseOption parses a single option (and its value) that is not terminating the parsing process.
+func parseOption(opt Option, arg string) error {
+	err2 := error(nil)
+	switch opt {
+	case PID:
+		Opts.PidFile, err2 = popStringArg("--pid")
+	case LineBufferSize:
+		Opts.LineBufferSize, err2 = popIntArg("--line-buffer-size")
+	case NoStdBuf:
+		Opts.NoStdBuf = true
+	case Pty:
+		Opts.Pty = true
+	case Config:
+		var fpath string
+		fpath, err2 = popStringArg(arg)
+		if err2 == nil {
+			err2 = loadConfig(fpath)
+			// options after --config must start a new command
+			cmdIdx = -1
+		}
+	case ShareCommands:
+		Opts.ShareCommands = true
+	case ShareStreams:
+		Opts.ShareStreams = true
+	case SignalPolicy:
+		err2 = addSignalPolicy(arg)
+	case KillAfter:
+		Opts.KillAfter, err2 = popDurationArg(arg)
+	case KillLadder:
+		err2 = parseKillLadder(arg)
+	case MaxRuntime:
+		Opts.MaxRuntime, err2 = popDurationArg(arg)
+	case MaxIdle:
+		Opts.MaxIdle, err2 = popDurationArg(arg)
+	case MaxSignal:
+		var sig *syscall.Signal
+		sig, err2 = popSignalPArg(arg)
+		if err2 == nil {
+			Opts.MaxSignal = *sig
+		}
+	case RestartOnExit:
+		Opts.RestartOnExit = true
+		if inlineValue != nil {
+			Opts.RestartCodes, err2 = parseExitCodes(arg, *inlineValue)
+			inlineValue = nil
+		}
+	case RestartMax:
+		Opts.RestartMax, err2 = popIntArg(arg)
+		if err2 == nil && Opts.RestartMax < 0 {
+			err2 = fmt.Errorf("%v cannot be negative", arg)
+		}
+	case RestartBackoff:
+		var d *time.Duration
+		d, err2 = popDurationArg(arg)
+		if err2 == nil {
+			Opts.RestartBackoff = *d
+		}
+	case RestartMaxWait:
+		var d *time.Duration
+		d, err2 = popDurationArg(arg)
+		if err2 == nil {
+			Opts.RestartMaxWait = *d
+		}
+	case RestartReset:
+		Opts.RestartReset = true
+	case RestartSignal:
+		var sig *syscall.Signal
+		sig, err2 = popSignalPArg(arg)
+		if err2 == nil {
+			Opts.RestartSignal = *sig
+		}
+	case InitialState:
+		Opts.InitialState, err2 = popNameArg(arg)
+	case StateFile:
+		Opts.StateFile, err2 = popStringArg(arg)
+	case RecordStart:
+		Opts.RecordStart, err2 = popRegexpArg(arg)
+	case RecordContinue:
+		Opts.RecordContinue, err2 = popRegexpArg(arg)
+	case RecordTimeout:
+		var d *time.Duration
+		d, err2 = popDurationArg(arg)
+		if err2 == nil {
+			Opts.RecordTimeout = *d
+		}
+	case PromptTimeout:
+		var d *time.Duration
+		d, err2 = popDurationArg(arg)
+		if err2 == nil && *d < 0 {
+			err2 = fmt.Errorf("%v cannot be negative", arg)
+		} else if err2 == nil {
+			Opts.PromptTimeout = *d
+		}
+	case OutputFormat:
+		Opts.OutputFormat, err2 = popStringArg(arg)
+		if err2 == nil && Opts.OutputFormat != "text" && Opts.OutputFormat != "json" && Opts.OutputFormat != "logfmt" {
+			err2 = fmt.Errorf("%v: invalid format %q, it must be text, json or logfmt", arg, Opts.OutputFormat)
+		}
+	case Timestamp:
+		Opts.Timestamp, err2 = popStringArg(arg)
+		if err2 == nil && Opts.Timestamp != "wall" && Opts.Timestamp != "elapsed" && Opts.Timestamp != "delta" {
+			err2 = fmt.Errorf("%v: invalid mode %q, it must be wall, elapsed or delta", arg, Opts.Timestamp)
+		}
+	case TimestampFormat:
+		Opts.TimestampFmt, err2 = popStringArg(arg)
+	case CRLines:
+		Opts.CRLines = true
+	case LongLines:
+		Opts.LongLines, err2 = popStringArg(arg)
+		if err2 == nil && Opts.LongLines != "split" && Opts.LongLines != "truncate" && Opts.LongLines != "fail" {
+			err2 = fmt.Errorf("%v: invalid policy %q, it must be split, truncate or fail", arg, Opts.LongLines)
+		}
+	case NewCommand:
+		addEmptyCommand()
+		currentCommand().Name, err2 = popOptName("command")
+	case Disabled:
+		currentCommand().Disabled = true
+	case LineDisabled:
+		currentCommand().LineDisabled = true
+	case LineEnabled:
+		currentCommand().LineEnabled = true
+	case Pattern:
+		err2 = addPattern(arg)
+	case Or:
+		currentConditions().Or = true
+	case No:
+		currentConditions().No = true
+	case StdErr:
+		currentConditions().StdOut = false
+		currentConditions().StdErr = true
+	case StdAll:
+		currentConditions().StdOut = true
+		currentConditions().StdErr = true
+	case AndTimeout:
+		currentConditions().AndTimeout, err2 = popDurationArg(arg)
+	case OrTimeout:
+		currentConditions().OrTimeout, err2 = popDurationArg(arg)
+	case MinMatchTime:
+		currentConditions().MinMatchTime, err2 = popDurationArg(arg)
+	case NoInputForDuration:
+		currentConditions().NoInputForDuration, err2 = popDurationArg(arg)
+	case OnSignal:
+		currentConditions().OnSignal, err2 = popSignalPArg(arg)
+	case MinCount:
+		currentConditions().MinCount, err2 = popIntPArg(arg)
+	case MaxCount:
+		currentConditions().MaxCount, err2 = popIntPArg(arg)
+	case Every:
+		currentConditions().Every, err2 = popIntPArg(arg)
+	case RateAbove:
+		currentConditions().Rate, err2 = popRateArg(arg)
+	case RateBelow:
+		currentConditions().RateBelow, err2 = popRateArg(arg)
+	case If:
+		var cond *VarCondition
+		cond, err2 = popVarConditionArg(arg)
+		if err2 == nil {
+			currentConditions().Vars = append(currentConditions().Vars, *cond)
+		}
+	case IfSet, IfUnset:
+		cond := VarCondition{Op: VarSet}
+		if opt == IfUnset {
+			cond.Op = VarUnset
+		}
+		cond.Name, err2 = popVarNameArg(arg)
+		currentConditions().Vars = append(currentConditions().Vars, cond)
+	case InState:
+		err2 = appendNameArg(arg, &currentConditions().InState)
+	case OnEnter:
+		currentConditions().OnEnter, err2 = popNamePArg(arg)
+	case OnExit:
+		currentConditions().OnExit, err2 = popNamePArg(arg)
+	case Field, FieldMatch, FieldGt, FieldLt:
+		op := map[Option]FieldOp{Field: FieldEquals, FieldMatch: FieldMatches, FieldGt: FieldGreater, FieldLt: FieldLess}[opt]
+		var cond *FieldCondition
+		cond, err2 = popFieldConditionArg(arg, op)
+		if err2 == nil {
+			currentConditions().Fields = append(currentConditions().Fields, *cond)
+		}
+	case FieldFormat:
+		var s string
+		s, err2 = popStringArg(arg)
+		if err2 == nil {
+			currentConditions().FieldFormat, err2 = fields.ParseFormat(s)
+		}
+	case Replace:
+		err2 = addReplacement(arg, false)
+	case ReplaceFirst:
+		err2 = addReplacement(arg, true)
+	case MarkStdout:
+		currentActions().MarkStdOut, err2 = popStringPArg(arg)
+	case MarkStdErr:
+		currentActions().MarkStdErr, err2 = popStringPArg(arg)
+	case SetPrefix:
+		currentActions().SetPrefix, err2 = popStringPArg(arg)
+	case SetSuffix:
+		currentActions().SetSuffix, err2 = popStringPArg(arg)
+	case FgColor:
+		var attr color.Attribute
+		attr, err2 = popColorFgAttrArg(arg)
+		if err2 == nil {
+			changeColorAttribute(attr)
+		}
+	case BgColor:
+		var attr color.Attribute
+		attr, err2 = popColorBgAttrArg(arg)
+		if err2 == nil {
+			changeColorAttribute(attr)
+		}
+	case Bold:
+		changeColorAttribute(color.Bold)
+	case Italic:
+		changeColorAttribute(color.Italic)
+	case Faint:
+		changeColorAttribute(color.Bold)
+	case Underline:
+		changeColorAttribute(color.Underline)
+	case BlinkSlow:
+		changeColorAttribute(color.BlinkSlow)
+	case BlinkRapid:
+		changeColorAttribute(color.BlinkRapid)
+	case SendToStdOut:
+		currentActions().SendToStdOut = true
+	case SendToStdErr:
+		currentActions().SendToStdErr = true
+	case Drop:
+		currentActions().Drop = true
+	case Next:
+		currentActions().NextLine = true
+	case SkipTo:
+		currentActions().SkipTo, err2 = popNamePArg(arg)
+	case Disable:
+		err2 = appendNameArg(arg, &currentActions().Disable)
+	case Enable:
+		err2 = appendNameArg(arg, &currentActions().Enable)
+	case Toggle:
+		err2 = appendNameArg(arg, &currentActions().Toggle)
+	case ResetCount:
+		err2 = appendNameArg(arg, &currentActions().ResetCount)
+	case SetVar:
+		var assignment *VarAssignment
+		assignment, err2 = popVarAssignmentArg(arg)
+		if err2 == nil {
+			currentActions().SetVar = append(currentActions().SetVar, *assignment)
+		}
+	case IncrVar:
+		var name string
+		name, err2 = popVarNameArg(arg)
+		currentActions().IncrVar = append(currentActions().IncrVar, name)
+	case UnsetVar:
+		var name string
+		name, err2 = popVarNameArg(arg)
+		currentActions().UnsetVar = append(currentActions().UnsetVar, name)
+	case GotoState:
+		currentActions().GotoState, err2 = popNamePArg(arg)
+	case Signal:
+		currentActions().Signal, err2 = popSignalPArg(arg)
+	case SignalGroup:
+		err2 = setSignalTarget(arg, TargetGroup)
+	case SignalTree:
+		err2 = setSignalTarget(arg, TargetTree)
+	case SignalPidFile:
+		err2 = setSignalTarget(arg, TargetPidFile)
+		if err2 == nil {
+			currentActions().SignalPidFile, err2 = popStringPArg(arg)
+		}
+	case SignalKillAfter:
+		currentActions().SignalKillAfter, err2 = popDurationArg(arg)
+	case Restart:
+		currentActions().Restart = true
+	case SendInput:
+		currentActions().Input, err2 = popStringPArg(arg)
+	case SendInputFile:
+		currentActions().InputFile, err2 = popStringPArg(arg)
+	case CloseStdin:
+		currentActions().CloseStdIn = true
+	case Exec, ExecSync:
+		if currentActions().Exec != nil {
+			return errors.New("--exec and --exec-sync can only be given once in a command")
+		}
+		currentActions().Exec, err2 = popStringPArg(arg)
+		currentActions().ExecSync = opt == ExecSync
+	case ExecExitCode:
+		currentActions().ExecExitCode = true
+	case SetExitCode:
+		var ec int
+		ec, err2 = popIntArg("--set-exit-code")
+		if ec < 0 || ec > 255 {
+			err2 = errors.New("--set-exit-code: code must be between 0 and 255")
+		} else {
+			var iec int32
+			iec = int32(ec)
+			currentActions().SetExitCode = &iec
+		}
+	case ClearExitCode:
+		currentActions().ClearExitCode = true
+	}
+	return err2
+}
+
 func changeColorAttribute(attr color.Attribute) {
 	if currentActions().Color == nil {
 		currentActions().Color = color.New(attr)
@@ -344,15 +704,97 @@ func isGlobalOption(opt Option) bool {
 		return true
 	case NoStdBuf:
 		return true
+	case Pty:
+		return true
+	case Config:
+		return true
 	case ShareCommands:
 		return true
 	case ShareStreams:
 		return true
+	case SignalPolicy:
+		return true
+	case KillAfter:
+		return true
+	case KillLadder:
+		return true
+	case MaxRuntime:
+		return true
+	case MaxIdle:
+		return true
+	case MaxSignal:
+		return true
+	case RestartOnExit, RestartMax, RestartBackoff, RestartMaxWait, RestartReset, RestartSignal:
+		return true
+	case InitialState, StateFile:
+		return true
+	case RecordStart, RecordContinue, RecordTimeout, PromptTimeout:
+		return true
+	case OutputFormat, Timestamp, TimestampFormat, CRLines, LongLines:
+		return true
+	default:
+		return false
+	}
+}
+
+// isCommandOption tells if the option changes the command itself (not its conditions or actions).
+func isCommandOption(opt Option) bool {
+	switch opt {
+	case Disabled, LineDisabled, LineEnabled:
+		return true
 	default:
 		return false
 	}
 }
 
+// isConditionOption tells if the option belongs to the conditions of a command.
+func isConditionOption(opt Option) bool {
+	switch opt {
+	case Pattern, Or, No, StdErr, StdAll, AndTimeout, OrTimeout, MinMatchTime, NoInputForDuration, OnSignal,
+		MinCount, MaxCount, Every, RateAbove, RateBelow, If, IfSet, IfUnset, InState, OnEnter, OnExit,
+		Field, FieldMatch, FieldGt, FieldLt, FieldFormat:
+		return true
+	default:
+		return false
+	}
+}
+
+// isActionOption tells if the option belongs to the actions of a command.
+func isActionOption(opt Option) bool {
+	return opt != NewCommand && !isGlobalOption(opt) && !isCommandOption(opt) && !isConditionOption(opt)
+}
+
+// Records tells if lines are grouped into multi-line records, see --record-start and --record-continue.
+func (o *Type) Records() bool {
+	return o.RecordStart != nil || o.RecordContinue != nil
+}
+
+// SendsInput tells if there is a command that can send input to PROGRAM.
+func (o *Type) SendsInput() bool {
+	for _, cmd := range o.Commands {
+		if cmd.Actions.Input != nil || cmd.Actions.InputFile != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// SignalsGroup tells if the process group or the process tree of PROGRAM is signaled: by a command, by --restart
+// (with --restart-signal), or when a global limit is exceeded. PROGRAM is only started in its own process group if it
+// is needed.
+func (o *Type) SignalsGroup() bool {
+	if o.MaxRuntime != nil || o.MaxIdle != nil {
+		return true
+	}
+	for _, cmd := range o.Commands {
+		a := cmd.Actions
+		if a.SignalTarget == TargetGroup || a.SignalTarget == TargetTree || (a.Restart && a.Signal == nil) {
+			return true
+		}
+	}
+	return false
+}
+
 func ParseArgs() (Type, error) {
 	err := internalParseArgs()
 	if err != nil {
@@ -387,6 +829,105 @@ func addPattern(arg string) error {
 	return nil
 }
 
+func addReplacement(arg string, first bool) error {
+	p, err := popStringArg(arg)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return fmt.Errorf("%v: pattern must not be empty", arg)
+	}
+	value, err := popStringArg(arg)
+	if err != nil {
+		return err
+	}
+	r := Replacement{RawPattern: p, Value: value, First: first}
+	currentActions().Replace = append(currentActions().Replace, r)
+	return nil
+}
+
+func setSignalTarget(arg string, target SignalTarget) error {
+	if currentActions().SignalTarget != TargetProcess {
+		return fmt.Errorf("%v: only one of --signal-group, --signal-tree and --signal-pid-file can be given", arg)
+	}
+	currentActions().SignalTarget = target
+	return nil
+}
+
+// addSignalPolicy parses SIGNAL=ACTION, where ACTION is forward, ignore, or the name of another signal
+func addSignalPolicy(arg string) error {
+	s, err := popStringArg(arg)
+	if err != nil {
+		return err
+	}
+	name, action, found := strings.Cut(s, "=")
+	if !found {
+		return fmt.Errorf("%v: value must be SIGNAL=ACTION", arg)
+	}
+	sig, err := parseSignal(arg, name)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(action) {
+	case "forward":
+		Opts.SignalPolicy[*sig] = *sig
+	case "ignore":
+		Opts.SignalPolicy[*sig] = 0
+	default:
+		target, err := parseSignal(arg, action)
+		if err != nil {
+			return err
+		}
+		Opts.SignalPolicy[*sig] = *target
+	}
+	return nil
+}
+
+// parseKillLadder parses a comma separated list of signals for --kill-ladder
+func parseKillLadder(arg string) error {
+	s, err := popStringArg(arg)
+	if err != nil {
+		return err
+	}
+	ladder := make([]syscall.Signal, 0)
+	for _, name := range strings.Split(s, ",") {
+		sig, err := parseSignal(arg, strings.TrimSpace(name))
+		if err != nil {
+			return err
+		}
+		ladder = append(ladder, *sig)
+	}
+	if len(ladder) < 2 {
+		return fmt.Errorf("%v: at least two signals must be given", arg)
+	}
+	Opts.KillLadder = ladder
+	return nil
+}
+
+// parseExitCodes parses a comma separated list of exit codes, e.g. --restart-on-exit=1,2
+func parseExitCodes(arg string, value string) ([]int, error) {
+	codes := make([]int, 0)
+	for _, s := range strings.Split(value, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || code < 0 || code > 255 {
+			return nil, fmt.Errorf("%v: invalid exit code %q, it must be between 0 and 255", arg, s)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// NextKillSignal returns the signal that follows sig in the kill ladder. It returns false if sig is not in the
+// ladder, or it is the last one.
+func (o *Type) NextKillSignal(sig syscall.Signal) (syscall.Signal, bool) {
+	for i, s := range o.KillLadder {
+		if s == sig && i+1 < len(o.KillLadder) {
+			return o.KillLadder[i+1], true
+		}
+	}
+	return 0, false
+}
+
 func currentCommand() *Command {
 	return &Opts.Commands[cmdIdx]
 }
@@ -4,19 +4,21 @@ import (
 	"fmt"
 	"github.com/fatih/color"
 	"golang.org/x/sys/unix"
-	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/nagylzs/tea/internal/vars"
 )
 
 func popStringArg(name string) (string, error) {
 	argIdx += 1
-	if argIdx >= len(os.Args) {
+	if argIdx >= len(args) {
 		return "", fmt.Errorf("missing value for %v", name)
 	}
-	return os.Args[argIdx], nil
+	return args[argIdx], nil
 }
 
 func popStringPArg(name string) (*string, error) {
@@ -28,10 +30,10 @@ func popStringPArg(name string) (*string, error) {
 }
 
 func popOptName(name string) (string, error) {
-	if argIdx+1 >= len(os.Args) {
+	if argIdx+1 >= len(args) {
 		return "", nil
 	}
-	n := os.Args[argIdx+1]
+	n := args[argIdx+1]
 	if n == "" {
 		return "", fmt.Errorf("name of %v cannot be empty", name)
 	}
@@ -89,6 +91,10 @@ func popSignalPArg(name string) (*syscall.Signal, error) {
 	if err != nil {
 		return nil, err
 	}
+	return parseSignal(name, s)
+}
+
+func parseSignal(name string, s string) (*syscall.Signal, error) {
 	signal := unix.SignalNum(strings.ToUpper(s))
 	if signal != 0 {
 		return &signal, nil
@@ -116,6 +122,117 @@ func popDurationArg(name string) (*time.Duration, error) {
 	return &result, nil
 }
 
+// popVarNameArg pops the name of a named variable
+func popVarNameArg(name string) (string, error) {
+	s, err := popStringArg(name)
+	if err != nil {
+		return "", err
+	}
+	if !vars.ValidName.MatchString(s) {
+		return "", fmt.Errorf("%v: invalid variable name %q, it can contain letters, digits and underscores", name, s)
+	}
+	return s, nil
+}
+
+// popVarAssignmentArg parses VAR=VALUE for --set
+func popVarAssignmentArg(name string) (*VarAssignment, error) {
+	s, err := popStringArg(name)
+	if err != nil {
+		return nil, err
+	}
+	varName, value, found := strings.Cut(s, "=")
+	if !found {
+		return nil, fmt.Errorf("%v: value must be given as VAR=VALUE", name)
+	}
+	if !vars.ValidName.MatchString(varName) {
+		return nil, fmt.Errorf("%v: invalid variable name %q, it can contain letters, digits and underscores", name, varName)
+	}
+	return &VarAssignment{Name: varName, Value: value}, nil
+}
+
+// popVarConditionArg parses VAR==VALUE or VAR!=VALUE for --if
+func popVarConditionArg(name string) (*VarCondition, error) {
+	s, err := popStringArg(name)
+	if err != nil {
+		return nil, err
+	}
+	cond := &VarCondition{Op: VarEquals}
+	i := strings.Index(s, "==")
+	if j := strings.Index(s, "!="); j >= 0 && (i < 0 || j < i) {
+		cond.Op, i = VarNotEquals, j
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("%v: condition must be given as VAR==VALUE or VAR!=VALUE", name)
+	}
+	cond.Name, cond.Value = s[:i], s[i+2:]
+	if !vars.ValidName.MatchString(cond.Name) {
+		return nil, fmt.Errorf("%v: invalid variable name %q, it can contain letters, digits and underscores", name, cond.Name)
+	}
+	return cond, nil
+}
+
+func popRegexpArg(name string) (*regexp.Regexp, error) {
+	s, err := popStringArg(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := regexp.Compile(s)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err.Error())
+	}
+	return r, nil
+}
+
+// popFieldConditionArg parses KEY=VALUE for --field, --field-match, --field-gt and --field-lt
+func popFieldConditionArg(name string, op FieldOp) (*FieldCondition, error) {
+	s, err := popStringArg(name)
+	if err != nil {
+		return nil, err
+	}
+	key, value, found := strings.Cut(s, "=")
+	if !found || key == "" {
+		return nil, fmt.Errorf("%v: condition must be given as KEY=VALUE", name)
+	}
+	cond := &FieldCondition{Key: key, Op: op, Value: value}
+	switch op {
+	case FieldMatches:
+		cond.Pattern, err = regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err.Error())
+		}
+	case FieldGreater, FieldLess:
+		cond.Number, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v: value of %v must be a number", name, key)
+		}
+	}
+	return cond, nil
+}
+
+// popRateArg parses a rate in N/DURATION format, e.g. 20/10s
+func popRateArg(name string) (*Rate, error) {
+	s, err := popStringArg(name)
+	if err != nil {
+		return nil, err
+	}
+	count, window, found := strings.Cut(s, "/")
+	if !found {
+		return nil, fmt.Errorf("%v: rate must be given as N/DURATION, e.g. 20/10s", name)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("%v: N must be a positive int", name)
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err.Error())
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("%v: DURATION must be positive", name)
+	}
+	return &Rate{Count: n, Window: d}, nil
+}
+
 func popColorFgAttrArg(name string) (color.Attribute, error) {
 	cname, err := popStringArg(name)
 	if err != nil {
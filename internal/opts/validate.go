@@ -5,7 +5,12 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/nagylzs/tea/internal/expand"
 )
 
 func validateOptions() error {
@@ -25,24 +30,87 @@ func validateOptions() error {
 		}
 	}
 
+	if Opts.StateFile != "" {
+		if _, err := os.Stat(Opts.StateFile); err == nil {
+			return fmt.Errorf("state file %s already exists", Opts.StateFile)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("state file %s: %v", Opts.StateFile, err.Error())
+		}
+	}
+
+	// default signal policy: forward signals that would terminate PROGRAM if it was started directly
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT} {
+		if _, exists := Opts.SignalPolicy[sig]; !exists {
+			Opts.SignalPolicy[sig] = sig
+		}
+	}
+	if _, exists := Opts.SignalPolicy[syscall.SIGWINCH]; !exists && !Opts.Pty {
+		// with --pty, the kernel sends SIGWINCH when the size of the pseudo-terminal is changed
+		Opts.SignalPolicy[syscall.SIGWINCH] = syscall.SIGWINCH
+	}
+
 	if Opts.LineBufferSize < 1024 {
 		return errors.New("--line-buffer-size must be at least 1024")
 	}
 
+	if Opts.RecordTimeout <= 0 {
+		return errors.New("--record-timeout must be positive")
+	}
+
+	if Opts.PromptTimeout < 0 {
+		// prompts are common on a terminal, but a pipe may be written in pieces by a program that is still busy
+		Opts.PromptTimeout = 0
+		if Opts.Pty {
+			Opts.PromptTimeout = 100 * time.Millisecond
+		}
+	}
+
+	if Opts.RestartBackoff <= 0 || Opts.RestartMaxWait < Opts.RestartBackoff {
+		return errors.New("--restart-backoff must be positive, and it cannot be greater than --restart-max-wait")
+	}
+
 	Opts.CmdIdx = make(map[string]int)
 	for i, cmd := range Opts.Commands {
 		if cmd.Name != "" {
 			_, exists := Opts.CmdIdx[cmd.Name]
 			if exists {
+				if cmd.Source != "" {
+					return fmt.Errorf("%v: duplicate command name %v", cmd.Source, cmd.Name)
+				}
 				return fmt.Errorf("duplicate command name %v", cmd.Name)
 			}
 			Opts.CmdIdx[cmd.Name] = i
 		}
 	}
 
+	// states can only be referenced when they can be entered
+	Opts.States = make(map[string]bool)
+	if Opts.InitialState != "" {
+		Opts.States[Opts.InitialState] = true
+	}
+	for _, cmd := range Opts.Commands {
+		if cmd.Actions.GotoState != nil {
+			Opts.States[*cmd.Actions.GotoState] = true
+		}
+	}
+
+	// variables can only be referenced when they are set by a command
+	varNames = make(map[string]bool)
+	for _, cmd := range Opts.Commands {
+		for _, assignment := range cmd.Actions.SetVar {
+			varNames[assignment.Name] = true
+		}
+		for _, name := range cmd.Actions.IncrVar {
+			varNames[name] = true
+		}
+	}
+
 	for i, cmd := range Opts.Commands {
 		err := validateCommand(i)
 		if err != nil {
+			if cmd.Source != "" {
+				return fmt.Errorf("%v: command #%v: %v", cmd.Source, i+1, err.Error())
+			}
 			if cmd.Name == "" {
 				return fmt.Errorf("command #%v: %v", i+1, err.Error())
 			} else {
@@ -54,6 +122,9 @@ func validateOptions() error {
 	return nil
 }
 
+// varNames contains the names of the variables that are set by --set or --incr
+var varNames map[string]bool
+
 func nTrue(b ...bool) int {
 	n := 0
 	for _, v := range b {
@@ -98,16 +169,78 @@ func validateCommand(cmdIdx int) error {
 		return errors.New("only a single timeout based condition can be given for a command")
 	}
 
-	if nNonNullDurations(c.AndTimeout, c.OrTimeout, c.MinMatchTime) > 1 {
-		return errors.New("--timeout, --or-timeout and --min-match-time is not implemented yet")
+	if c.MinMatchTime != nil && !c.MatchesLines() {
+		return errors.New("--min-match-time requires at least one --pattern or field condition")
 	}
 
-	hasLine := c.NoInputForDuration == nil
-
-	if !hasLine && len(c.CompiledPatterns) > 0 {
+	if c.NoInputForDuration != nil && c.MatchesLines() {
 		return errors.New("--no-input-for-duration cannot be combined with pattern matching")
 	}
 
+	if c.OnSignal != nil && (c.MatchesLines() || nNonNullDurations(c.AndTimeout, c.OrTimeout, c.MinMatchTime, c.NoInputForDuration) > 0) {
+		return errors.New("--on-signal cannot be combined with pattern matching or time based conditions")
+	}
+
+	if nNonNullDurations(c.AndTimeout, c.OrTimeout, c.MinMatchTime) > 0 && (cmd.LineDisabled || cmd.LineEnabled) {
+		return errors.New("--timeout, --or-timeout and --min-match-time cannot be combined with --line-disabled or --line-enabled")
+	}
+
+	for _, n := range []struct {
+		value *int
+		name  string
+	}{{c.MinCount, "--min-count"}, {c.MaxCount, "--max-count"}, {c.Every, "--every"}} {
+		if n.value != nil && *n.value < 1 {
+			return fmt.Errorf("%v must be at least 1", n.name)
+		}
+	}
+
+	if c.MinCount != nil && c.MaxCount != nil && *c.MinCount > *c.MaxCount {
+		return errors.New("--min-count cannot be greater than --max-count")
+	}
+
+	if c.Rate != nil && c.RateBelow != nil {
+		return errors.New("--rate and --rate-below cannot be combined")
+	}
+
+	if cmd.HasRate() && (nNonNullDurations(c.AndTimeout, c.OrTimeout, c.MinMatchTime, c.NoInputForDuration) > 0 || c.OnSignal != nil) {
+		return errors.New("--rate and --rate-below cannot be combined with time based conditions or --on-signal")
+	}
+
+	if c.RateBelow != nil && (cmd.LineDisabled || cmd.LineEnabled) {
+		return errors.New("--rate-below cannot be combined with --line-disabled or --line-enabled")
+	}
+
+	for _, cond := range c.Vars {
+		if !varNames[cond.Name] {
+			return fmt.Errorf("variable %v is not set by any command, use --set or --incr", cond.Name)
+		}
+	}
+
+	states := append([]string{}, c.InState...)
+	for _, state := range []*string{c.OnEnter, c.OnExit} {
+		if state != nil {
+			states = append(states, *state)
+		}
+	}
+	for _, state := range states {
+		if !Opts.States[state] {
+			return fmt.Errorf("state %v is never entered, use --initial-state or --goto-state", state)
+		}
+	}
+
+	if c.OnEnter != nil && c.OnExit != nil {
+		return errors.New("--on-enter and --on-exit cannot be combined")
+	}
+
+	if cmd.IsStateHook() && (c.MatchesLines() || nNonNullDurations(c.AndTimeout, c.OrTimeout, c.MinMatchTime, c.NoInputForDuration) > 0 ||
+		c.OnSignal != nil || cmd.HasRate()) {
+		return errors.New("--on-enter and --on-exit cannot be combined with pattern matching, time based conditions or --on-signal")
+	}
+
+	// time based commands can fire between two lines, so they have no current line
+	hasLine := nNonNullDurations(c.AndTimeout, c.OrTimeout, c.MinMatchTime, c.NoInputForDuration) == 0 && c.OnSignal == nil &&
+		c.RateBelow == nil && !cmd.IsStateHook()
+
 	a := cmd.Actions
 
 	if a.SendToStdOut && a.SendToStdErr {
@@ -118,6 +251,22 @@ func validateCommand(cmdIdx int) error {
 		return errors.New("this command has no 'current line', cannot --send-to-stdout or --send-to-stderr")
 	}
 
+	if !hasLine && a.Drop {
+		return errors.New("this command has no 'current line', cannot --drop")
+	}
+
+	if !hasLine && len(a.Replace) > 0 {
+		return errors.New("this command has no 'current line', cannot --replace or --replace-first")
+	}
+
+	for i := range a.Replace {
+		r, err := regexp.Compile(a.Replace[i].RawPattern)
+		if err != nil {
+			return err
+		}
+		a.Replace[i].CompiledPattern = r
+	}
+
 	if !hasLine && (a.MarkStdOut != nil || a.MarkStdErr != nil) {
 		return errors.New("this command has no 'current line', cannot --mark-to-stdout or --mark-to-stderr")
 	}
@@ -130,6 +279,44 @@ func validateCommand(cmdIdx int) error {
 		return errors.New("this command has no 'current line', cannot set color attributes")
 	}
 
+	type templateAction struct {
+		raw      *string
+		compiled **expand.Template
+		name     string
+	}
+	templates := []templateAction{
+		{a.MarkStdOut, &a.CompiledMarkStdOut, "--mark"},
+		{a.MarkStdErr, &a.CompiledMarkStdErr, "--mark-stderr"},
+		{a.SetPrefix, &a.CompiledSetPrefix, "--set-prefix"},
+		{a.SetSuffix, &a.CompiledSetSuffix, "--set-suffix"},
+		{a.Input, &a.CompiledInput, "--send-input"},
+	}
+	for i := range a.SetVar {
+		templates = append(templates, templateAction{&a.SetVar[i].Value, &a.SetVar[i].CompiledValue, "--set"})
+	}
+	for _, t := range templates {
+		if t.raw == nil {
+			continue
+		}
+		compiled, err := compileTemplate(*t.raw, c, hasLine)
+		if err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+		*t.compiled = compiled
+	}
+
+	if a.SignalKillAfter != nil && a.Signal == nil {
+		return errors.New("--signal-kill-after can only be used with --signal")
+	}
+
+	if a.SignalTarget != TargetProcess && a.Signal == nil {
+		return errors.New("--signal-group, --signal-tree and --signal-pid-file can only be used with --signal")
+	}
+
+	if a.ExecExitCode && a.Exec == nil {
+		return errors.New("--exec-exit-code can only be used with --exec or --exec-sync")
+	}
+
 	if a.SetExitCode != nil && a.ClearExitCode {
 		return errors.New("--set-exit-code and --clear-exit-code cannot be combined")
 	}
@@ -147,6 +334,12 @@ func validateCommand(cmdIdx int) error {
 		return err
 	}
 
+	for _, name := range a.ResetCount {
+		if _, exists := Opts.CmdIdx[name]; !exists {
+			return fmt.Errorf("--reset-count: cannot find command with name %v", name)
+		}
+	}
+
 	if a.SkipTo != nil {
 		i, exists := Opts.CmdIdx[*a.SkipTo]
 		if !exists {
@@ -160,6 +353,75 @@ func validateCommand(cmdIdx int) error {
 	return nil
 }
 
+// TemplateVars are the built-in template variables. The ones marked with true need a current line.
+var TemplateVars = map[string]bool{
+	"line":      true,
+	"lineno":    true,
+	"stream":    true,
+	"time":      false,
+	"command":   false,
+	"count":     false,
+	"state":     false,
+	"timestamp": true,
+}
+
+// compileTemplate parses a templated string action, and checks that all referenced variables exist. Numbered and named
+// groups of the patterns are also available when the command has a current line.
+func compileTemplate(raw string, c *CommandConditions, hasLine bool) (*expand.Template, error) {
+	t, err := expand.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range t.Vars() {
+		needsLine, isGroup := false, false
+		if n, err := strconv.Atoi(name); err == nil {
+			if n < 0 {
+				return nil, fmt.Errorf("invalid group number ${%v}", name)
+			}
+			for _, pat := range c.CompiledPatterns {
+				isGroup = isGroup || n <= pat.NumSubexp()
+			}
+			if !isGroup {
+				return nil, fmt.Errorf("there is no pattern with group ${%v}", name)
+			}
+		} else {
+			for _, pat := range c.CompiledPatterns {
+				isGroup = isGroup || pat.SubexpIndex(name) >= 0
+			}
+			var isBuiltin bool
+			needsLine, isBuiltin = TemplateVars[name]
+			if ref, ok := strings.CutPrefix(name, "count:"); ok && !isGroup {
+				// ${count:NAME} is the match counter of another command
+				if _, exists := Opts.CmdIdx[ref]; !exists {
+					return nil, fmt.Errorf("${%v}: cannot find command with name %v", name, ref)
+				}
+				isBuiltin = true
+			}
+			if _, ok := strings.CutPrefix(name, "field:"); ok && !isGroup {
+				// ${field:KEY} is a field of a structured log line, a missing field is expanded to an empty string
+				isBuiltin, needsLine = true, true
+			}
+			if ref, ok := strings.CutPrefix(name, "var:"); ok && !isGroup {
+				// ${var:NAME} is a named variable, an unset variable is expanded to an empty string
+				if !varNames[ref] {
+					return nil, fmt.Errorf("${%v}: variable %v is not set by any command, use --set or --incr", name, ref)
+				}
+				isBuiltin = true
+			}
+			if !isGroup && !isBuiltin {
+				return nil, fmt.Errorf("unknown variable ${%v}", name)
+			}
+		}
+		if name == "timestamp" && !isGroup && Opts.Timestamp == "" {
+			return nil, errors.New("${timestamp} can only be used with --timestamp")
+		}
+		if (isGroup || needsLine) && !hasLine {
+			return nil, fmt.Errorf("this command has no 'current line', cannot use ${%v}", name)
+		}
+	}
+	return t, nil
+}
+
 func nNonNullDurations(values ...*time.Duration) int {
 	cnt := 0
 	for _, value := range values {
@@ -0,0 +1,72 @@
+package proc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Descendants returns the process ids of all descendants of a process, by walking /proc. Children are listed before
+// grandchildren.
+func Descendants(pid int) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		ppid, err := parentPid(child)
+		if err != nil {
+			// the process may have exited since listing /proc
+			continue
+		}
+		children[ppid] = append(children[ppid], child)
+	}
+	result := make([]int, 0)
+	queue := children[pid]
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		result = append(result, p)
+		queue = append(queue, children[p]...)
+	}
+	return result, nil
+}
+
+// parentPid reads the parent process id from /proc/PID/stat.
+func parentPid(pid int) (int, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// the second field is the command name in parentheses, and it may contain spaces
+	s := string(data)
+	end := strings.LastIndexByte(s, ')')
+	if end < 0 {
+		return 0, errors.New("invalid stat format")
+	}
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 2 {
+		return 0, errors.New("invalid stat format")
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// ReadPidFile reads a process id from a pid file.
+func ReadPidFile(fpath string) (int, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("%v does not contain a valid process id", fpath)
+	}
+	return pid, nil
+}
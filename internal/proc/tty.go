@@ -0,0 +1,54 @@
+package proc
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ForegroundTerminal opens the controlling terminal of tea. It returns nil if tea has no controlling terminal, or tea
+// is not in its foreground process group (e.g. it was started in the background by a shell).
+func ForegroundTerminal() *os.File {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil
+	}
+	if !IsForeground(tty, syscall.Getpgrp()) {
+		_ = tty.Close()
+		return nil
+	}
+	return tty
+}
+
+// InForeground tells if tea is in the foreground process group of its controlling terminal.
+func InForeground() bool {
+	tty := ForegroundTerminal()
+	if tty == nil {
+		return false
+	}
+	_ = tty.Close()
+	return true
+}
+
+// IsForeground tells if pgrp is the foreground process group of a terminal.
+func IsForeground(tty *os.File, pgrp int) bool {
+	foreground, err := unix.IoctlGetInt(int(tty.Fd()), unix.TIOCGPGRP)
+	return err == nil && foreground == pgrp
+}
+
+// SetForeground makes pgrp the foreground process group of a terminal. It can also be called by a process that is not
+// in the foreground process group.
+func SetForeground(tty *os.File, pgrp int) error {
+	// a background process gets SIGTTOU when it changes the foreground process group, unless it ignores SIGTTOU
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	return unix.IoctlSetPointerInt(int(tty.Fd()), unix.TIOCSPGRP, pgrp)
+}
+
+// IsControllingTerminal tells if a file is the controlling terminal of tea.
+func IsControllingTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetInt(int(f.Fd()), unix.TIOCGPGRP)
+	return err == nil
+}
@@ -0,0 +1,40 @@
+package proc
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// WaitExit blocks until the child process exits. The process is not reaped, so exec.Cmd.Wait can still be used to
+// collect its exit status.
+func WaitExit(pid int) error {
+	for {
+		var info unix.Siginfo
+		err := unix.Waitid(unix.P_PID, pid, &info, unix.WEXITED|unix.WNOWAIT, nil)
+		if !errors.Is(err, unix.EINTR) {
+			return err
+		}
+	}
+}
+
+// cldStopped is the siginfo code of a child that was stopped by a signal
+const cldStopped = 5
+
+// WaitStop blocks until the child process is stopped by a signal (e.g. SIGTSTP), and returns true. It returns false
+// when the process exits. The process is not reaped.
+func WaitStop(pid int) (bool, error) {
+	for {
+		var info unix.Siginfo
+		err := unix.Waitid(unix.P_PID, pid, &info, unix.WEXITED|unix.WSTOPPED|unix.WNOWAIT, nil)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil || info.Code != cldStopped {
+			return false, err
+		}
+		// consume the stop, so that the next call waits for the next one
+		_ = unix.Waitid(unix.P_PID, pid, &info, unix.WSTOPPED|unix.WNOHANG, nil)
+		return true, nil
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package proc
+
+import "errors"
+
+// WaitExit is not supported on this platform, it always returns an error.
+func WaitExit(pid int) error {
+	return errors.New("waiting for process exit is not supported on this platform")
+}
+
+// WaitStop is not supported on this platform, it always returns an error.
+func WaitStop(pid int) (bool, error) {
+	return false, errors.New("waiting for process stop is not supported on this platform")
+}
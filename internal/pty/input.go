@@ -0,0 +1,20 @@
+package pty
+
+import (
+	"os"
+)
+
+// Input is the stdin of PROGRAM when it is running under a pseudo-terminal. Closing the master side would hang up the
+// terminal, so Close sends an end of file character instead.
+type Input struct {
+	Master *os.File
+}
+
+func (i Input) Write(data []byte) (int, error) {
+	return i.Master.Write(data)
+}
+
+func (i Input) Close() error {
+	_, err := i.Master.Write([]byte{EOF(i.Master)})
+	return err
+}
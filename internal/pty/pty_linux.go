@@ -0,0 +1,64 @@
+package pty
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Open creates a new pseudo-terminal, and returns its master and slave sides. Echo and output newline translation
+// (\n -> \r\n) are turned off on the slave side, so that lines written by PROGRAM can be processed as they are, and
+// input sent by tea is not repeated on the output.
+func Open() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		_ = master.Close()
+		return nil, nil, fmt.Errorf("unlockpt: %v", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, fmt.Errorf("ptsname: %v", err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, err
+	}
+	termios, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+	if err == nil {
+		termios.Lflag &^= unix.ECHO | unix.ECHONL
+		termios.Oflag &^= unix.ONLCR
+		err = unix.IoctlSetTermios(int(slave.Fd()), unix.TCSETS, termios)
+	}
+	if err != nil {
+		_ = master.Close()
+		_ = slave.Close()
+		return nil, nil, fmt.Errorf("cannot set terminal attributes: %v", err)
+	}
+	return master, slave, nil
+}
+
+// InheritSize copies the window size of the terminal "from" to the pseudo-terminal. It returns an error if "from" is
+// not a terminal. The kernel sends SIGWINCH to the foreground process group of the pseudo-terminal when its size changes.
+func InheritSize(master *os.File, from *os.File) error {
+	ws, err := unix.IoctlGetWinsize(int(from.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return err
+	}
+	return unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, ws)
+}
+
+// EOF returns the character that signals end of file, when written to the master side of the pseudo-terminal.
+func EOF(master *os.File) byte {
+	termios, err := unix.IoctlGetTermios(int(master.Fd()), unix.TCGETS)
+	if err != nil || termios.Cc[unix.VEOF] == 0 {
+		return 4 // ^D
+	}
+	return termios.Cc[unix.VEOF]
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package pty
+
+import (
+	"errors"
+	"os"
+)
+
+var errNotSupported = errors.New("--pty is only supported on Linux")
+
+func Open() (*os.File, *os.File, error) {
+	return nil, nil, errNotSupported
+}
+
+func InheritSize(master *os.File, from *os.File) error {
+	return errNotSupported
+}
+
+func EOF(master *os.File) byte {
+	return 4
+}
@@ -0,0 +1,162 @@
+package stdin
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// ErrClosed is returned when writing to a Mux that has already been closed.
+var ErrClosed = errors.New("stdin of PROGRAM is closed")
+
+// Mux serializes writes to the stdin of PROGRAM. Data forwarded from tea's own stdin is written line by line, and
+// injected data (e.g. --send-input) is written between two forwarded lines, so they never get mixed up.
+//
+// All writes are performed by a single writer goroutine. Injected data and close requests are queued, so the command
+// chains never block on the stdin of PROGRAM (they must keep reading its output, otherwise PROGRAM could stall).
+type Mux struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []request
+	closed  bool // stdin is closed, or it will be closed when the queue is processed
+	onError func(error)
+}
+
+// request is a write, close or reopen request, performed by the writer goroutine in the order of the queue
+type request struct {
+	data   []byte
+	reader io.ReadCloser  // copied to stdin instead of data, and closed after the copy
+	close  bool           // close stdin
+	reopen io.WriteCloser // replace stdin
+	done   chan error     // receives the result, errors of requests without done are passed to onError
+}
+
+// CreateMux creates a Mux and starts its writer goroutine. onError is called (from the writer goroutine) when a queued
+// request fails.
+func CreateMux(writer io.WriteCloser, onError func(error)) *Mux {
+	m := &Mux{onError: onError}
+	m.cond = sync.NewCond(&m.mu)
+	go m.run(writer)
+	return m
+}
+
+// push adds a request to the queue. It returns ErrClosed if stdin is closed.
+func (m *Mux) push(r request) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed && r.reopen == nil {
+		return ErrClosed
+	}
+	m.closed = r.close || (m.closed && r.reopen == nil)
+	m.queue = append(m.queue, r)
+	m.cond.Signal()
+	return nil
+}
+
+// run performs the queued requests
+func (m *Mux) run(writer io.WriteCloser) {
+	for {
+		m.mu.Lock()
+		for len(m.queue) == 0 {
+			m.cond.Wait()
+		}
+		r := m.queue[0]
+		m.queue = m.queue[1:]
+		m.mu.Unlock()
+
+		var err error
+		switch {
+		case r.reopen != nil:
+			writer = r.reopen
+		case r.close:
+			err = writer.Close()
+			if errors.Is(err, os.ErrClosed) {
+				err = nil
+			}
+		case r.reader != nil:
+			_, err = io.Copy(writer, r.reader)
+			_ = r.reader.Close()
+		default:
+			_, err = writer.Write(r.data)
+		}
+		if r.done != nil {
+			r.done <- err
+		} else if err != nil && m.onError != nil {
+			m.onError(err)
+		}
+	}
+}
+
+// Write queues data to be written atomically to the stdin of PROGRAM. It does not wait for the write.
+func (m *Mux) Write(data []byte) (int, error) {
+	if err := m.push(request{data: append([]byte(nil), data...)}); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// WriteFrom queues reader to be copied to the stdin of PROGRAM, and closed after the copy. It does not wait for the
+// copy. The data is written atomically, forwarded lines and other injected data are not written until the copy is
+// finished. The reader is closed immediately if stdin is closed.
+func (m *Mux) WriteFrom(reader io.ReadCloser) error {
+	if err := m.push(request{reader: reader}); err != nil {
+		_ = reader.Close()
+		return err
+	}
+	return nil
+}
+
+// Reopen replaces the stdin of PROGRAM with writer, when a new instance of PROGRAM is started. The previous writer
+// should be closed before.
+func (m *Mux) Reopen(writer io.WriteCloser) {
+	_ = m.push(request{reopen: writer})
+}
+
+// Close closes the stdin of PROGRAM after the queued writes. It can be called multiple times.
+func (m *Mux) Close() {
+	_ = m.push(request{close: true})
+}
+
+// Forward copies lines from reader to the stdin of PROGRAM, until reader reaches EOF. Lines longer than bufSize are
+// forwarded in multiple chunks. Each write is waited for, so tea does not read ahead of PROGRAM. Lines are discarded
+// while the Mux is closed, or PROGRAM is not running, because the Mux may be reopened when PROGRAM is restarted. It
+// returns nil on EOF.
+func (m *Mux) Forward(reader io.Reader, bufSize int) error {
+	r := bufio.NewReaderSize(reader, bufSize)
+	done := make(chan error, 1)
+	batch := make([]byte, 0, bufSize)
+	for {
+		data, err := r.ReadSlice('\n')
+		if len(data) > 0 {
+			// complete lines that are already buffered are written together, so that each line does not have to wait
+			// for the writer goroutine
+			batch = append(batch[:0], data...)
+			if err == nil && r.Buffered() > 0 {
+				buffered, _ := r.Peek(r.Buffered())
+				if i := bytes.LastIndexByte(buffered, '\n'); i >= 0 {
+					batch = append(batch, buffered[:i+1]...)
+					_, _ = r.Discard(i + 1)
+				}
+			}
+			if m.push(request{data: batch, done: done}) == nil {
+				werr := <-done
+				if werr != nil && !errors.Is(werr, os.ErrClosed) && !errors.Is(werr, syscall.EPIPE) {
+					return werr
+				}
+			}
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
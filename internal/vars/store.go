@@ -0,0 +1,66 @@
+package vars
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// ValidName matches the names of variables. Names can be used in environment variables, so they are restricted to
+// letters, digits and underscores.
+var ValidName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Store holds the named variables of --set, --incr and --unset. There is a single store that is shared by all command
+// chains, and the chains may run concurrently, so access is serialized.
+type Store struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func CreateStore() *Store {
+	return &Store{values: make(map[string]string)}
+}
+
+// Get returns the value of a variable. The second return value is false if the variable is not set.
+func (s *Store) Get(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[name]
+	return value, ok
+}
+
+func (s *Store) Set(name string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[name] = value
+}
+
+func (s *Store) Unset(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, name)
+}
+
+// Incr increments an integer variable, and returns its new value. A variable that is not set, or that is not an
+// integer, is treated as zero.
+func (s *Store) Incr(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, _ := strconv.Atoi(s.values[name])
+	value++
+	s.values[name] = strconv.Itoa(value)
+	return value
+}
+
+// Environ returns the variables as environment variables with the given prefix, sorted by name.
+func (s *Store) Environ(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	env := make([]string, 0, len(s.values))
+	for name, value := range s.values {
+		env = append(env, prefix+name+"="+value)
+	}
+	slices.Sort(env)
+	return env
+}